@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// APIKeys is an Authenticator for static API keys sent in the X-Api-Key
+// header
+type APIKeys struct {
+	// keys are stored as hashes so the lookup does not depend on the key
+	keys map[[sha256.Size]byte]Identity
+}
+
+// NewAPIKeys creates an APIKeys authenticator from a map of key to identity
+func NewAPIKeys(keys map[string]Identity) *APIKeys {
+	a := &APIKeys{keys: map[[sha256.Size]byte]Identity{}}
+
+	for k, id := range keys {
+		id.Method = MethodAPIKey
+		a.keys[sha256.Sum256([]byte(k))] = id
+	}
+
+	return a
+}
+
+// ParseAPIKeys reads API keys, one per line or separated by ;, in the format
+// "key subject [role,role]". Blank lines and lines starting with # are
+// ignored.
+func ParseAPIKeys(r io.Reader) (map[string]Identity, error) {
+	keys := map[string]Identity{}
+
+	s := bufio.NewScanner(r)
+	n := 0
+	for s.Scan() {
+		for _, entry := range strings.Split(s.Text(), ";") {
+			n++
+			entry = strings.TrimSpace(entry)
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+
+			f := strings.Fields(entry)
+			if len(f) < 2 || len(f) > 3 {
+				return nil, fmt.Errorf("invalid API key entry %d, expected \"key subject [role,role]\"", n)
+			}
+
+			if _, ok := keys[f[0]]; ok {
+				return nil, fmt.Errorf("duplicate API key for subject %s", f[1])
+			}
+
+			id := Identity{Subject: f[1]}
+			if len(f) == 3 {
+				for _, role := range strings.Split(f[2], ",") {
+					if role = strings.TrimSpace(role); role != "" {
+						id.Roles = append(id.Roles, role)
+					}
+				}
+			}
+
+			keys[f[0]] = id
+		}
+	}
+
+	return keys, s.Err()
+}
+
+// LoadAPIKeys reads API keys from a file, see ParseAPIKeys
+func LoadAPIKeys(path string) (map[string]Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseAPIKeys(f)
+}
+
+// Authenticate implements Authenticator
+func (a *APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	k := r.Header.Get(APIKeyHeader)
+	if k == "" {
+		return nil, ErrNoCredentials
+	}
+
+	id, ok := a.keys[sha256.Sum256([]byte(k))]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &id, nil
+}
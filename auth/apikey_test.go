@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys(strings.NewReader("# keys\nabc nic admin,ops\n\ndef erik;ghi jake"))
+
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+	assert.Equal(t, Identity{Subject: "nic", Roles: []string{"admin", "ops"}}, keys["abc"])
+	assert.Equal(t, "jake", keys["ghi"].Subject)
+}
+
+func TestParseAPIKeysReturnsErrorForInvalidEntry(t *testing.T) {
+	_, err := ParseAPIKeys(strings.NewReader("abc"))
+	assert.Error(t, err)
+
+	_, err = ParseAPIKeys(strings.NewReader("abc nic;abc erik"))
+	assert.Error(t, err)
+}
+
+func TestAPIKeysAuthenticate(t *testing.T) {
+	a := NewAPIKeys(map[string]Identity{"abc": {Subject: "nic"}})
+	r := httptest.NewRequest("GET", "/", nil)
+
+	_, err := a.Authenticate(r)
+	assert.Equal(t, ErrNoCredentials, err)
+
+	r.Header.Set(APIKeyHeader, "def")
+	_, err = a.Authenticate(r)
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	r.Header.Set(APIKeyHeader, "abc")
+	id, err := a.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "nic", id.Subject)
+	assert.Equal(t, MethodAPIKey, id.Method)
+}
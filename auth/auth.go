@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// APIKeyHeader is the header clients use to send their API key
+const APIKeyHeader = "X-Api-Key"
+
+// Authentication methods
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request does not
+// contain credentials it understands
+var ErrNoCredentials = errors.New("no credentials")
+
+// ErrInvalidCredentials is returned by an Authenticator when the credentials
+// in the request are not valid
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Identity is the authenticated client making a request
+type Identity struct {
+	// Subject identifies the client, the API key owner or the JWT subject
+	Subject string
+	// Method is the authentication method used [api_key,jwt]
+	Method string
+	// Roles granted to the client
+	Roles []string
+}
+
+// HasRole returns true when the identity has been granted the role
+func (i *Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticator authenticates the credentials in a request
+type Authenticator interface {
+	// Authenticate returns the identity of the client, ErrNoCredentials is
+	// returned when the request does not contain credentials for the
+	// authenticator
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Chain is an Authenticator which tries each Authenticator in turn, the first
+// one which finds credentials in the request decides the result
+type Chain []Authenticator
+
+// Authenticate implements Authenticator
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+
+		return id, err
+	}
+
+	return nil, ErrNoCredentials
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx which carries the identity
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity carried by ctx or nil when the request
+// was not authenticated
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// SubjectFromContext returns the subject of the identity carried by ctx or an
+// empty string
+func SubjectFromContext(ctx context.Context) string {
+	if id := FromContext(ctx); id != nil {
+		return id.Subject
+	}
+
+	return ""
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticAuthenticator struct {
+	id  *Identity
+	err error
+}
+
+func (s staticAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	return s.id, s.err
+}
+
+func TestChainSkipsAuthenticatorsWithoutCredentials(t *testing.T) {
+	c := Chain{
+		staticAuthenticator{nil, ErrNoCredentials},
+		staticAuthenticator{&Identity{Subject: "nic"}, nil},
+	}
+
+	id, err := c.Authenticate(httptest.NewRequest("GET", "/", nil))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "nic", id.Subject)
+}
+
+func TestChainReturnsFirstError(t *testing.T) {
+	c := Chain{
+		staticAuthenticator{nil, ErrInvalidCredentials},
+		staticAuthenticator{&Identity{Subject: "nic"}, nil},
+	}
+
+	_, err := c.Authenticate(httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestChainReturnsNoCredentials(t *testing.T) {
+	_, err := Chain{}.Authenticate(httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, ErrNoCredentials, err)
+}
+
+func TestContextCarriesIdentity(t *testing.T) {
+	ctx := NewContext(context.Background(), &Identity{Subject: "nic", Roles: []string{"admin"}})
+
+	assert.Equal(t, "nic", SubjectFromContext(ctx))
+	assert.True(t, FromContext(ctx).HasRole("admin"))
+	assert.Equal(t, "", SubjectFromContext(context.Background()))
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// leeway is the clock skew allowed when validating token expiry
+const leeway = 30 * time.Second
+
+// KeySet is a set of public keys used to verify tokens, indexed by key id
+type KeySet map[string]interface{}
+
+// JWTConfig configures the validation of JWT bearer tokens
+type JWTConfig struct {
+	// Secret verifies tokens signed with HMAC [HS256,HS384,HS512]
+	Secret []byte
+	// Keys verify tokens signed with RSA or ECDSA, the key is selected by the
+	// kid header of the token
+	Keys KeySet
+	// Issuer is the required iss claim, empty accepts any issuer
+	Issuer string
+	// Audience is the required aud claim, empty accepts any audience
+	Audience string
+}
+
+// JWT is an Authenticator for JWT bearer tokens sent in the Authorization
+// header. The subject is read from the sub claim and roles from the roles
+// claim, tokens must have an expiry.
+type JWT struct {
+	config JWTConfig
+	parser *jwt.Parser
+}
+
+type claims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles,omitempty"`
+}
+
+// NewJWT creates a JWT authenticator, at least one of the secret or keys must
+// be set
+func NewJWT(c JWTConfig) (*JWT, error) {
+	var methods []string
+	if len(c.Secret) > 0 {
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+
+	if len(c.Keys) > 0 {
+		methods = append(methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512")
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("a secret or keys are required to validate tokens")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithLeeway(leeway),
+		jwt.WithExpirationRequired(),
+	}
+
+	if c.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(c.Issuer))
+	}
+
+	if c.Audience != "" {
+		opts = append(opts, jwt.WithAudience(c.Audience))
+	}
+
+	return &JWT{config: c, parser: jwt.NewParser(opts...)}, nil
+}
+
+// Authenticate implements Authenticator
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+
+	var c claims
+	if _, err := j.parser.ParseWithClaims(strings.TrimSpace(h[7:]), &c, j.key); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	if c.Subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidCredentials)
+	}
+
+	return &Identity{Subject: c.Subject, Method: MethodJWT, Roles: c.Roles}, nil
+}
+
+// key returns the key to verify the token, the key type must match the
+// signing method so a public key can not be used as an HMAC secret
+func (j *JWT) key(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		return j.config.Secret, nil
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	k, ok := j.config.Keys[kid]
+	if !ok && kid == "" && len(j.config.Keys) == 1 {
+		for _, v := range j.config.Keys {
+			k, ok = v, true
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	switch t.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, ok := k.(*rsa.PublicKey); ok {
+			return k, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := k.(*ecdsa.PublicKey); ok {
+			return k, nil
+		}
+	}
+
+	return nil, fmt.Errorf("key %q can not verify %s tokens", kid, t.Method.Alg())
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS parses a JSON Web Key Set containing RSA and EC public keys, keys
+// for encryption are ignored
+func ParseJWKS(data []byte) (KeySet, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %s", err)
+	}
+
+	ks := KeySet{}
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+
+		pk, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %s", k.Kid, err)
+		}
+
+		ks[k.Kid] = pk
+	}
+
+	return ks, nil
+}
+
+// LoadJWKS reads a JSON Web Key Set from a file, see ParseJWKS
+func LoadJWKS(path string) (KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseJWKS(data)
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// decodeInt decodes a base64url encoded big endian integer
+func decodeInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing key parameter")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+var secret = []byte("supersecret")
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	return r
+}
+
+func signToken(t *testing.T, m jwt.SigningMethod, key interface{}, kid string, c jwt.MapClaims) string {
+	tok := jwt.NewWithClaims(m, c)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+
+	s, err := tok.SignedString(key)
+	assert.NoError(t, err)
+
+	return s
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":   "nic",
+		"iss":   "emojify",
+		"aud":   "api",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"roles": []string{"admin"},
+	}
+}
+
+func TestNewJWTReturnsErrorWithoutKeys(t *testing.T) {
+	_, err := NewJWT(JWTConfig{})
+
+	assert.Error(t, err)
+}
+
+func TestJWTReturnsNoCredentialsWithoutBearerToken(t *testing.T) {
+	j, _ := NewJWT(JWTConfig{Secret: secret})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Basic abc")
+
+	_, err := j.Authenticate(r)
+
+	assert.Equal(t, ErrNoCredentials, err)
+}
+
+func TestJWTAuthenticatesHMACToken(t *testing.T) {
+	j, _ := NewJWT(JWTConfig{Secret: secret, Issuer: "emojify", Audience: "api"})
+
+	id, err := j.Authenticate(bearerRequest(signToken(t, jwt.SigningMethodHS256, secret, "", validClaims())))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "nic", id.Subject)
+	assert.Equal(t, MethodJWT, id.Method)
+	assert.True(t, id.HasRole("admin"))
+}
+
+func TestJWTRejectsInvalidTokens(t *testing.T) {
+	j, _ := NewJWT(JWTConfig{Secret: secret, Issuer: "emojify", Audience: "api"})
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "someone"
+
+	noSubject := validClaims()
+	delete(noSubject, "sub")
+
+	tokens := map[string]string{
+		"wrong secret": signToken(t, jwt.SigningMethodHS256, []byte("other"), "", validClaims()),
+		"expired":      signToken(t, jwt.SigningMethodHS256, secret, "", expired),
+		"no expiry":    signToken(t, jwt.SigningMethodHS256, secret, "", noExpiry),
+		"wrong issuer": signToken(t, jwt.SigningMethodHS256, secret, "", wrongIssuer),
+		"no subject":   signToken(t, jwt.SigningMethodHS256, secret, "", noSubject),
+		"malformed":    "abc.def.ghi",
+	}
+
+	for name, tok := range tokens {
+		_, err := j.Authenticate(bearerRequest(tok))
+		assert.True(t, errors.Is(err, ErrInvalidCredentials), name)
+	}
+}
+
+func TestJWTAuthenticatesTokensSignedWithJWKSKeys(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ek, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"RSA","kid":"rsa","n":"%s","e":"%s"},
+		{"kty":"EC","kid":"ec","crv":"P-256","x":"%s","y":"%s"},
+		{"kty":"RSA","kid":"enc","use":"enc","n":"","e":""}
+	]}`, b64(rk.N), b64(big.NewInt(int64(rk.E))), b64(ek.X), b64(ek.Y))
+
+	keys, err := ParseJWKS([]byte(jwks))
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	j, _ := NewJWT(JWTConfig{Keys: keys})
+
+	_, err = j.Authenticate(bearerRequest(signToken(t, jwt.SigningMethodRS256, rk, "rsa", validClaims())))
+	assert.NoError(t, err)
+
+	_, err = j.Authenticate(bearerRequest(signToken(t, jwt.SigningMethodES256, ek, "ec", validClaims())))
+	assert.NoError(t, err)
+
+	// a token must be verified by the key with the matching type
+	_, err = j.Authenticate(bearerRequest(signToken(t, jwt.SigningMethodRS256, rk, "ec", validClaims())))
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	// HMAC tokens are not accepted without a secret
+	_, err = j.Authenticate(bearerRequest(signToken(t, jwt.SigningMethodHS256, secret, "rsa", validClaims())))
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+}
+
+func TestParseJWKSReturnsErrorForInvalidKeys(t *testing.T) {
+	_, err := ParseJWKS([]byte(`{"keys":[{"kty":"oct","kid":"a","k":"abc"}]}`))
+	assert.Error(t, err)
+
+	_, err = ParseJWKS([]byte(`{"keys":[{"kty":"EC","kid":"a","crv":"P-192","x":"AQ","y":"AQ"}]}`))
+	assert.Error(t, err)
+
+	_, err = ParseJWKS([]byte(`not json`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,230 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/emojify-app/api/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrOpen is returned without calling the upstream when the breaker is open
+var ErrOpen = status.Error(codes.Unavailable, "circuit breaker is open")
+
+// State is the state of a Breaker
+type State int
+
+// States of a Breaker
+const (
+	// StateClosed allows all calls
+	StateClosed State = iota
+	// StateOpen rejects all calls until the reset timeout has elapsed
+	StateOpen
+	// StateHalfOpen allows a limited number of trial calls, the breaker closes
+	// when they succeed and opens again when any fails
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+
+	return "closed"
+}
+
+// Config configures a Breaker
+type Config struct {
+	// FailureThreshold is the number of consecutive failures which open the
+	// breaker
+	FailureThreshold int
+	// ResetTimeout is the time the breaker stays open before allowing trial
+	// calls
+	ResetTimeout time.Duration
+	// HalfOpenRequests is the number of trial calls which must succeed to
+	// close the breaker
+	HalfOpenRequests int
+}
+
+// Breaker is a circuit breaker which stops calls to an upstream after
+// repeated failures
+type Breaker struct {
+	name   string
+	config Config
+	logger logging.Logger
+
+	mutex      sync.Mutex
+	state      State
+	generation int
+	failures   int
+	openedAt   time.Time
+	inFlight   int
+	successes  int
+
+	now func() time.Time
+}
+
+// New creates a new Breaker, the name identifies the upstream in logs and
+// metrics
+func New(name string, config Config, l logging.Logger) *Breaker {
+	if config.FailureThreshold < 1 {
+		config.FailureThreshold = 1
+	}
+
+	if config.HalfOpenRequests < 1 {
+		config.HalfOpenRequests = 1
+	}
+
+	return &Breaker{name: name, config: config, logger: l, now: time.Now}
+}
+
+// Name returns the name of the upstream protected by the breaker
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() State {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == StateOpen && b.now().Sub(b.openedAt) >= b.config.ResetTimeout {
+		return StateHalfOpen
+	}
+
+	return b.state
+}
+
+// Call calls f when the breaker allows it and records the result, returns
+// ErrOpen without calling f when the breaker is open
+func (b *Breaker) Call(f func() error) error {
+	gen, err := b.allow()
+	if err != nil {
+		return err
+	}
+
+	err = f()
+	b.done(gen, err)
+
+	return err
+}
+
+func (b *Breaker) allow() (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if b.now().Sub(b.openedAt) < b.config.ResetTimeout {
+			b.logger.CircuitBreakerRejected(b.name)
+			return 0, ErrOpen
+		}
+
+		b.setState(StateHalfOpen)
+		fallthrough
+
+	case StateHalfOpen:
+		if b.inFlight >= b.config.HalfOpenRequests {
+			b.logger.CircuitBreakerRejected(b.name)
+			return 0, ErrOpen
+		}
+
+		b.inFlight++
+	}
+
+	return b.generation, nil
+}
+
+func (b *Breaker) done(gen int, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// the state changed while the call was running, the result no longer
+	// applies
+	if gen != b.generation {
+		return
+	}
+
+	failed := IsFailure(err)
+
+	switch b.state {
+	case StateClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.setState(StateOpen)
+		}
+
+	case StateHalfOpen:
+		b.inFlight--
+
+		// a cancelled call says nothing about the upstream, the slot is
+		// released for another trial call
+		if isCanceled(err) {
+			return
+		}
+
+		if failed {
+			b.setState(StateOpen)
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.setState(StateClosed)
+		}
+	}
+}
+
+// setState changes the state and resets the counters, must be called with
+// the mutex held
+func (b *Breaker) setState(s State) {
+	from := b.state
+
+	b.state = s
+	b.generation++
+	b.failures = 0
+	b.inFlight = 0
+	b.successes = 0
+
+	if s == StateOpen {
+		b.openedAt = b.now()
+	}
+
+	b.logger.CircuitBreakerStateChanged(b.name, from.String(), s.String())
+}
+
+// IsFailure returns true when err indicates the upstream is unhealthy, errors
+// such as NotFound or a cancelled request do not count towards opening the
+// breaker
+func IsFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal, codes.Unknown:
+		return true
+	}
+
+	return false
+}
+
+// isCanceled returns true when the call was cancelled by the caller
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled
+}
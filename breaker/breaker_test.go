@@ -0,0 +1,152 @@
+package breaker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errUnavailable = status.Error(codes.Unavailable, "down")
+
+func setupBreaker() (*Breaker, *logging.InMemorySink, *time.Time) {
+	sink := logging.NewInMemorySink()
+	b := New("emojify", Config{FailureThreshold: 2, ResetTimeout: 10 * time.Second, HalfOpenRequests: 1}, logging.New("test", sink, "error", "text"))
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	return b, sink, &now
+}
+
+func fail() error    { return errUnavailable }
+func succeed() error { return nil }
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b, sink, _ := setupBreaker()
+
+	b.Call(fail)
+	assert.Equal(t, StateClosed, b.State())
+
+	b.Call(fail)
+	assert.Equal(t, StateOpen, b.State())
+	assert.Equal(t, 1, sink.Count("service.api.circuit_breaker.state_changed"))
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	b, _, _ := setupBreaker()
+
+	b.Call(fail)
+	b.Call(succeed)
+	b.Call(fail)
+
+	assert.Equal(t, StateClosed, b.State())
+}
+
+func TestBreakerIgnoresNonFailureErrors(t *testing.T) {
+	b, _, _ := setupBreaker()
+
+	for i := 0; i < 5; i++ {
+		b.Call(func() error { return status.Error(codes.NotFound, "missing") })
+	}
+
+	assert.Equal(t, StateClosed, b.State())
+}
+
+func TestOpenBreakerRejectsWithoutCalling(t *testing.T) {
+	b, sink, _ := setupBreaker()
+	b.Call(fail)
+	b.Call(fail)
+
+	called := false
+	err := b.Call(func() error { called = true; return nil })
+
+	assert.Equal(t, ErrOpen, err)
+	assert.False(t, called)
+	assert.Equal(t, 1, sink.Count("service.api.circuit_breaker.rejected"))
+}
+
+func TestBreakerClosesAfterSuccessfulHalfOpenCall(t *testing.T) {
+	b, _, now := setupBreaker()
+	b.Call(fail)
+	b.Call(fail)
+
+	*now = now.Add(11 * time.Second)
+	assert.Equal(t, StateHalfOpen, b.State())
+
+	assert.NoError(t, b.Call(succeed))
+	assert.Equal(t, StateClosed, b.State())
+}
+
+func TestBreakerReopensAfterFailedHalfOpenCall(t *testing.T) {
+	b, _, now := setupBreaker()
+	b.Call(fail)
+	b.Call(fail)
+
+	*now = now.Add(11 * time.Second)
+	b.Call(fail)
+
+	assert.Equal(t, StateOpen, b.State())
+	assert.Equal(t, ErrOpen, b.Call(succeed))
+}
+
+func TestBreakerIgnoresCancelledHalfOpenCall(t *testing.T) {
+	b, _, now := setupBreaker()
+	b.Call(fail)
+	b.Call(fail)
+
+	*now = now.Add(11 * time.Second)
+	b.Call(func() error { return status.Error(codes.Canceled, "gone") })
+	assert.Equal(t, StateHalfOpen, b.State())
+
+	b.Call(func() error { return fmt.Errorf("wrapped: %w", context.Canceled) })
+	assert.Equal(t, StateHalfOpen, b.State())
+
+	assert.NoError(t, b.Call(succeed))
+	assert.Equal(t, StateClosed, b.State())
+}
+
+func TestBreakerLimitsHalfOpenCalls(t *testing.T) {
+	b, _, now := setupBreaker()
+	b.Call(fail)
+	b.Call(fail)
+	*now = now.Add(11 * time.Second)
+
+	var inner error
+	b.Call(func() error {
+		inner = b.Call(succeed)
+		return nil
+	})
+
+	assert.Equal(t, ErrOpen, inner)
+}
+
+func TestIsFailure(t *testing.T) {
+	assert.True(t, IsFailure(errUnavailable))
+	assert.True(t, IsFailure(status.Error(codes.DeadlineExceeded, "slow")))
+	assert.True(t, IsFailure(fmt.Errorf("wrapped: %w", context.DeadlineExceeded)))
+	assert.False(t, IsFailure(nil))
+	assert.False(t, IsFailure(status.Error(codes.NotFound, "missing")))
+	assert.False(t, IsFailure(status.Error(codes.Canceled, "gone")))
+}
+
+func TestEmojifyClientFailsFastWhenOpen(t *testing.T) {
+	b, _, _ := setupBreaker()
+	m := &emojify.ClientMock{}
+	m.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(nil, errUnavailable)
+
+	c := NewEmojifyClient(m, b)
+	for i := 0; i < 3; i++ {
+		c.Query(context.Background(), &wrappers.StringValue{Value: "abc"})
+	}
+
+	m.AssertNumberOfCalls(t, "Query", 2)
+}
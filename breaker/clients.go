@@ -0,0 +1,101 @@
+package breaker
+
+import (
+	"context"
+
+	"github.com/emojify-app/cache/protos/cache"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+)
+
+// EmojifyClient is an emojify.EmojifyClient which calls the upstream through
+// a Breaker, health checks bypass the breaker so they report the real state
+// of the upstream
+type EmojifyClient struct {
+	client  emojify.EmojifyClient
+	breaker *Breaker
+}
+
+// NewEmojifyClient wraps c with the breaker b
+func NewEmojifyClient(c emojify.EmojifyClient, b *Breaker) *EmojifyClient {
+	return &EmojifyClient{c, b}
+}
+
+// Check calls the health check of the upstream
+func (e *EmojifyClient) Check(ctx context.Context, in *emojify.HealthCheckRequest, opts ...grpc.CallOption) (*emojify.HealthCheckResponse, error) {
+	return e.client.Check(ctx, in, opts...)
+}
+
+// Create creates a job when the breaker allows it
+func (e *EmojifyClient) Create(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*emojify.QueryItem, error) {
+	var resp *emojify.QueryItem
+	err := e.breaker.Call(func() (err error) {
+		resp, err = e.client.Create(ctx, in, opts...)
+		return err
+	})
+
+	return resp, err
+}
+
+// Query queries a job when the breaker allows it
+func (e *EmojifyClient) Query(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*emojify.QueryItem, error) {
+	var resp *emojify.QueryItem
+	err := e.breaker.Call(func() (err error) {
+		resp, err = e.client.Query(ctx, in, opts...)
+		return err
+	})
+
+	return resp, err
+}
+
+// CacheClient is a cache.CacheClient which calls the upstream through a
+// Breaker, health checks bypass the breaker so they report the real state of
+// the upstream
+type CacheClient struct {
+	client  cache.CacheClient
+	breaker *Breaker
+}
+
+// NewCacheClient wraps c with the breaker b
+func NewCacheClient(c cache.CacheClient, b *Breaker) *CacheClient {
+	return &CacheClient{c, b}
+}
+
+// Check calls the health check of the upstream
+func (c *CacheClient) Check(ctx context.Context, in *cache.HealthCheckRequest, opts ...grpc.CallOption) (*cache.HealthCheckResponse, error) {
+	return c.client.Check(ctx, in, opts...)
+}
+
+// Put stores an item when the breaker allows it
+func (c *CacheClient) Put(ctx context.Context, in *cache.CacheItem, opts ...grpc.CallOption) (*wrappers.StringValue, error) {
+	var resp *wrappers.StringValue
+	err := c.breaker.Call(func() (err error) {
+		resp, err = c.client.Put(ctx, in, opts...)
+		return err
+	})
+
+	return resp, err
+}
+
+// Get fetches an item when the breaker allows it
+func (c *CacheClient) Get(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*cache.CacheItem, error) {
+	var resp *cache.CacheItem
+	err := c.breaker.Call(func() (err error) {
+		resp, err = c.client.Get(ctx, in, opts...)
+		return err
+	})
+
+	return resp, err
+}
+
+// Exists checks for an item when the breaker allows it
+func (c *CacheClient) Exists(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*wrappers.BoolValue, error) {
+	var resp *wrappers.BoolValue
+	err := c.breaker.Call(func() (err error) {
+		resp, err = c.client.Exists(ctx, in, opts...)
+		return err
+	})
+
+	return resp, err
+}
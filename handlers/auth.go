@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/logging"
+)
+
+// Authentication is a middleware which authenticates requests to a group of
+// routes, the identity of the client is added to the request context
+type Authentication struct {
+	logger        logging.Logger
+	group         string
+	authenticator auth.Authenticator
+	required      bool
+	failures      *RateLimiter
+}
+
+// NewAuthentication creates a new Authentication middleware for the route
+// group, when required is false requests without credentials are allowed but
+// requests with invalid credentials are rejected. Each request with invalid
+// credentials takes a token from the bucket of the client in failures, when
+// the bucket is empty requests from the client are rejected with 429 before
+// their credentials are checked. A nil failures does not limit failed
+// requests.
+func NewAuthentication(l logging.Logger, group string, a auth.Authenticator, required bool, failures *RateLimiter) *Authentication {
+	return &Authentication{l, group, a, required, failures}
+}
+
+// Middleware is used by gorilla/mux to create a middleware
+func (a *Authentication) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// clients which have sent too many invalid credentials can not try
+		// any more until their bucket refills, the request is not
+		// authenticated so the failure bucket is always keyed by IP
+		var failureKey string
+		if a.failures != nil {
+			failureKey = a.failures.clientKey(r)
+			if ok, retry := a.failures.peek(failureKey); !ok {
+				a.logger.WithContext(r.Context()).RateLimitRejected(a.failures.group, failureKey)
+
+				rw.Header().Set("Retry-After", strconv.Itoa(seconds(retry)))
+				writeError(rw, r, http.StatusTooManyRequests, "too many failed authentication attempts", nil)
+				return
+			}
+		}
+
+		id, err := a.authenticator.Authenticate(r)
+
+		if err == auth.ErrNoCredentials {
+			if !a.required {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			a.logger.WithContext(r.Context()).AuthenticationFailed(a.group, "missing", err)
+			a.unauthorized(rw, r, "authentication required")
+			return
+		}
+
+		if err != nil {
+			a.logger.WithContext(r.Context()).AuthenticationFailed(a.group, "invalid", err)
+			if a.failures != nil {
+				a.failures.take(failureKey)
+			}
+
+			a.unauthorized(rw, r, "invalid credentials")
+			return
+		}
+
+		next.ServeHTTP(rw, r.WithContext(auth.NewContext(r.Context(), id)))
+	})
+}
+
+func (a *Authentication) unauthorized(rw http.ResponseWriter, r *http.Request, message string) {
+	rw.Header().Set("WWW-Authenticate", `Bearer realm="emojify"`)
+	writeError(rw, r, http.StatusUnauthorized, message, nil)
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupAuthentication(required bool) (http.Handler, *string) {
+	return setupLimitedAuthentication(required, nil)
+}
+
+// setupLimitedAuthentication creates the middleware, failed requests are
+// limited by failures when it is not nil
+func setupLimitedAuthentication(required bool, failures *RateLimiter) (http.Handler, *string) {
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+	keys := auth.NewAPIKeys(map[string]auth.Identity{"abc": {Subject: "nic"}})
+
+	subject := new(string)
+	a := NewAuthentication(logger, "emojify", keys, required, failures)
+	h := a.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*subject = auth.SubjectFromContext(r.Context())
+	}))
+
+	return h, subject
+}
+
+func authenticatedRequest(h http.Handler, key string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	if key != "" {
+		r.Header.Set(auth.APIKeyHeader, key)
+	}
+
+	h.ServeHTTP(rw, r)
+
+	return rw
+}
+
+func TestAuthenticationAddsIdentityToContext(t *testing.T) {
+	h, subject := setupAuthentication(true)
+
+	rw := authenticatedRequest(h, "abc")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "nic", *subject)
+}
+
+func TestAuthenticationReturns401WhenCredentialsMissing(t *testing.T) {
+	h, _ := setupAuthentication(true)
+
+	rw := authenticatedRequest(h, "")
+
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.NotEmpty(t, rw.Header().Get("WWW-Authenticate"))
+}
+
+func TestAuthenticationReturns401WhenCredentialsInvalid(t *testing.T) {
+	h, _ := setupAuthentication(false)
+
+	rw := authenticatedRequest(h, "def")
+
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
+
+func TestAuthenticationAllowsAnonymousWhenNotRequired(t *testing.T) {
+	h, subject := setupAuthentication(false)
+
+	rw := authenticatedRequest(h, "")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "", *subject)
+}
+
+func TestAuthenticationLimitsFailedAttempts(t *testing.T) {
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+	failures, _ := NewRateLimiter(logger, "auth", RateLimit{Rate: 0.001, Burst: 2, Key: RateLimitKeyIP})
+	h, _ := setupLimitedAuthentication(false, failures)
+
+	assert.Equal(t, http.StatusOK, authenticatedRequest(h, "abc").Code)
+	assert.Equal(t, http.StatusUnauthorized, authenticatedRequest(h, "def").Code)
+	assert.Equal(t, http.StatusUnauthorized, authenticatedRequest(h, "ghi").Code)
+
+	// valid credentials are not checked once the limit is reached so they
+	// can not be guessed
+	rw := authenticatedRequest(h, "abc")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.NotEmpty(t, rw.Header().Get("Retry-After"))
+}
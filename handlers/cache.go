@@ -1,8 +1,14 @@
 package handlers
 
 import (
-	"context"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/emojify-app/api/logging"
 	"github.com/emojify-app/cache/protos/cache"
@@ -14,39 +20,90 @@ import (
 
 // Cache returns images from the cache
 type Cache struct {
-	logger logging.Logger
-	cache  cache.CacheClient
+	logger  logging.Logger
+	cache   cache.CacheClient
+	timeout time.Duration
+	jobs    JobStore
+	maxAge  time.Duration
+	uploads bool
+
+	modTimes *modTimes
+}
+
+// maxModTimes is the maximum number of image modification times which are
+// remembered
+const maxModTimes = 10000
+
+// NewCache creates a new http.Handler for dealing with cache requests, timeout
+// is the maximum duration to wait for the cache service. When jobs is set the
+// image for a job can only be fetched by the clients which can access the
+// job. Images are immutable, clients may cache them for maxAge.
+func NewCache(l logging.Logger, c cache.CacheClient, timeout time.Duration, jobs JobStore, maxAge time.Duration) *Cache {
+	return &Cache{l, c, timeout, jobs, maxAge, false, newModTimes(maxModTimes)}
 }
 
-// NewCache creates a new http.Handler for dealing with cache requests
-func NewCache(l logging.Logger, c cache.CacheClient) *Cache {
-	return &Cache{l, c}
+// NewUploads creates a new http.Handler which returns images uploaded to
+// POST /emojify from the cache. Uploads are fetched by the emojify service
+// which can not authenticate so they can be fetched by anyone, images of jobs
+// are not returned.
+func NewUploads(l logging.Logger, c cache.CacheClient, timeout time.Duration, maxAge time.Duration) *Cache {
+	return &Cache{l, c, timeout, nil, maxAge, true, newModTimes(maxModTimes)}
 }
 
 // ServeHTTP handles requests for cache
 func (c *Cache) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	done := c.logger.CacheHandlerCalled(r)
+	logger := c.logger.WithContext(r.Context())
+	done := logger.CacheHandlerCalled(r)
 	vars := mux.Vars(r) // Get varaibles from the request path
 
 	// check the parameters contains a valid url
 	f := vars["id"]
 	if f == "" {
-		c.logger.CacheHandlerBadRequest()
+		logger.CacheHandlerBadRequest()
 		done(http.StatusBadRequest, nil)
 
-		rw.WriteHeader(http.StatusBadRequest)
+		writeError(rw, r, http.StatusBadRequest, "id is a required parameter", nil)
+		return
+	}
+
+	// only uploads are returned by the uploads handler and images of jobs
+	// owned by another client are reported as not found
+	if (c.uploads && !strings.HasPrefix(f, uploadIDPrefix)) || !canAccessJob(c.jobs, r, f) {
+		logger.JobAccessDenied(f)
+		done(http.StatusNotFound, nil)
+
+		writeError(rw, r, http.StatusNotFound, "image not found in cache", nil)
 		return
 	}
 
 	// fetch the file from the cache
-	cgd := c.logger.CacheHandlerGetFile(f)
-	d, err := c.cache.Get(context.Background(), &wrappers.StringValue{Value: f})
+	cgd := logger.CacheHandlerGetFile(f)
+	ctx, cancel := upstreamContext(r, c.timeout)
+	defer cancel()
+
+	d, err := c.cache.Get(ctx, &wrappers.StringValue{Value: f})
 
 	if s := status.Convert(err); s != nil && s.Code() == codes.NotFound {
 		cgd(http.StatusNotFound, nil)
 		done(http.StatusNotFound, nil)
 
-		rw.WriteHeader(http.StatusNotFound)
+		writeError(rw, r, http.StatusNotFound, "image not found in cache", err)
+		return
+	}
+
+	if isCircuitOpen(err) {
+		cgd(http.StatusServiceUnavailable, err)
+		done(http.StatusServiceUnavailable, nil)
+
+		writeError(rw, r, http.StatusServiceUnavailable, "cache service is unavailable", err)
+		return
+	}
+
+	if isDeadlineExceeded(err) {
+		cgd(http.StatusGatewayTimeout, err)
+		done(http.StatusGatewayTimeout, nil)
+
+		writeError(rw, r, http.StatusGatewayTimeout, "timeout fetching image from cache", err)
 		return
 	}
 
@@ -56,16 +113,89 @@ func (c *Cache) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		cgd(http.StatusInternalServerError, err)
 		done(http.StatusInternalServerError, nil)
 
-		rw.WriteHeader(http.StatusNotFound)
+		writeError(rw, r, http.StatusNotFound, "image not found in cache", err)
 		return
 	}
 
 	cgd(http.StatusOK, nil)
 
-	fileType := http.DetectContentType(d.Data)
+	// images are immutable, clients revalidate with the ETag or the time the
+	// image was first served
+	etag := contentETag(d.Data)
+
+	rw.Header().Set("ETag", etag)
+	rw.Header().Set("Cache-Control", c.cacheControl(f))
+	rw.Header().Set("Content-Type", http.DetectContentType(d.Data))
+
+	// ServeContent handles conditional and range requests, partial content is
+	// returned with 206 so interrupted downloads can be resumed
+	sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+	http.ServeContent(sw, r, "", c.modTimes.get(etag), bytes.NewReader(d.Data))
+	done(sw.status, nil)
+}
+
+// cacheControl returns the Cache-Control header for the image, only images of
+// public jobs can be stored by shared caches. Jobs whose owners are not known
+// can only be fetched by admins so they are private too.
+func (c *Cache) cacheControl(id string) string {
+	scope := "public"
+	if c.jobs != nil {
+		if _, public := c.jobs.Owners(id); !public {
+			scope = "private"
+		}
+	}
+
+	return fmt.Sprintf("%s, max-age=%d, immutable", scope, int(c.maxAge.Seconds()))
+}
+
+// contentETag returns a strong ETag for the content
+func contentETag(data []byte) string {
+	h := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(h[:16]) + `"`
+}
+
+// modTimes records the time content with an ETag was first served, the
+// cache service does not store modification times. Times are keyed by ETag so
+// changed content always has a later time than any copy held by a client.
+type modTimes struct {
+	mutex sync.Mutex
+	times map[string]time.Time
+	max   int
+	now   func() time.Time
+}
+
+func newModTimes(max int) *modTimes {
+	return &modTimes{times: map[string]time.Time{}, max: max, now: time.Now}
+}
+
+// get returns the time the content was first served truncated to seconds,
+// when max times are stored all times are forgotten which can only cause
+// clients to fetch an image again
+func (m *modTimes) get(etag string) time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if t, ok := m.times[etag]; ok {
+		return t
+	}
+
+	if len(m.times) >= m.max {
+		m.times = map[string]time.Time{}
+	}
+
+	t := m.now().UTC().Truncate(time.Second)
+	m.times[etag] = t
+
+	return t
+}
+
+// statusWriter records the status code written to the client
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
 
-	// all ok return the file
-	rw.Header().Add("content-type", fileType)
-	rw.Write(d.Data)
-	done(http.StatusOK, nil)
+func (s *statusWriter) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
 }
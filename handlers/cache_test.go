@@ -1,11 +1,15 @@
 package handlers
 
 import (
+	"context"
 	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/breaker"
 	"github.com/emojify-app/api/logging"
 	"github.com/emojify-app/cache/protos/cache"
 	"github.com/golang/protobuf/ptypes/wrappers"
@@ -23,7 +27,7 @@ var mockCache cache.ClientMock
 func setupCacheHandler() (*httptest.ResponseRecorder, *http.Request, *Cache) {
 	mockCache = cache.ClientMock{}
 	base64URL = base64.StdEncoding.EncodeToString([]byte(fileURL))
-	logger, _ := logging.New("test", "test", "localhost:8125", "error", "text")
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
 
 	rw := httptest.NewRecorder()
 	r := httptest.NewRequest(
@@ -35,7 +39,7 @@ func setupCacheHandler() (*httptest.ResponseRecorder, *http.Request, *Cache) {
 	// Set the gorilla mux vars for testing
 	r = mux.SetURLVars(r, map[string]string{"id": base64URL})
 
-	h := &Cache{logger, &mockCache}
+	h := NewCache(logger, &mockCache, 0, nil, time.Hour)
 
 	return rw, r, h
 }
@@ -77,3 +81,256 @@ func TestReturns200WhenImageFound(t *testing.T) {
 	assert.Equal(t, 200, rw.Code)
 	assert.Equal(t, "abc", rw.Body.String())
 }
+
+func TestReturns504WhenCacheDeadlineExceeded(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On(
+		"Get",
+		mock.Anything,
+		&wrappers.StringValue{Value: base64URL},
+		mock.Anything,
+	).Return(nil, status.Error(codes.DeadlineExceeded, "timeout"))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+}
+
+func TestReturns503WhenCacheCircuitOpen(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(nil, breaker.ErrOpen)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+}
+
+func TestCacheContextIsDerivedFromRequest(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	h.timeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(ctx)
+	cancel()
+
+	mockCache.On(
+		"Get",
+		mock.MatchedBy(func(ctx context.Context) bool {
+			_, hasDeadline := ctx.Deadline()
+			return ctx.Err() == context.Canceled && hasDeadline
+		}),
+		&wrappers.StringValue{Value: base64URL},
+		mock.Anything,
+	).Return(&cache.CacheItem{Data: []byte("abc")}, nil)
+
+	h.ServeHTTP(rw, r)
+
+	mockCache.AssertExpectations(t)
+}
+
+func TestReturns404WhenImageOwnedByAnotherClient(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	jobs := NewMemoryJobStore(time.Hour, 10)
+	jobs.Add("nic", Job{ID: base64URL})
+	h.jobs = jobs
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	mockCache.AssertNotCalled(t, "Get", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestReturns404WhenImageOwnerUnknown(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	h.jobs = NewMemoryJobStore(time.Hour, 10)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	mockCache.AssertNotCalled(t, "Get", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUploadsAreServedSeparatelyFromOwnedImages(t *testing.T) {
+	mockCache = cache.ClientMock{}
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abc")}, nil)
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	jobs := NewMemoryJobStore(time.Hour, 10)
+	jobs.Add("nic", Job{ID: "owned"})
+
+	images := NewCache(logger, &mockCache, 0, jobs, time.Hour)
+	uploads := NewUploads(logger, &mockCache, 0, time.Hour)
+
+	get := func(h http.Handler, id string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"id": id})
+
+		h.ServeHTTP(rw, r)
+		return rw
+	}
+
+	upload := get(uploads, uploadIDPrefix+"abc")
+	assert.Equal(t, http.StatusOK, upload.Code)
+	assert.Equal(t, "public, max-age=3600, immutable", upload.Header().Get("Cache-Control"))
+
+	assert.Equal(t, http.StatusNotFound, get(images, "owned").Code)
+	assert.Equal(t, http.StatusNotFound, get(uploads, "owned").Code)
+	assert.Equal(t, http.StatusNotFound, get(images, uploadIDPrefix+"abc").Code)
+	mockCache.AssertNumberOfCalls(t, "Get", 1)
+}
+
+func TestReturnsCachingHeadersWhenImageFound(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abc")}, nil)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, `"ba7816bf8f01cfea414140de5dae2223"`, rw.Header().Get("ETag"))
+	assert.Equal(t, "public, max-age=3600, immutable", rw.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, rw.Header().Get("Last-Modified"))
+}
+
+func TestReturnsPrivateCacheControlWhenImageOwned(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abc")}, nil)
+	jobs := NewMemoryJobStore(time.Hour, 10)
+	jobs.Add("nic", Job{ID: base64URL})
+	h.jobs = jobs
+
+	r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: "nic"}))
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "private, max-age=3600, immutable", rw.Header().Get("Cache-Control"))
+}
+
+func TestReturnsPrivateCacheControlWhenImageOwnerUnknown(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abc")}, nil)
+	h.jobs = NewMemoryJobStore(time.Hour, 10)
+
+	r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: "erik", Roles: []string{AdminRole}}))
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "private, max-age=3600, immutable", rw.Header().Get("Cache-Control"))
+}
+
+func TestReturnsPublicCacheControlWhenJobPublic(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abc")}, nil)
+	jobs := NewMemoryJobStore(time.Hour, 10)
+	jobs.Add("", Job{ID: base64URL})
+	h.jobs = jobs
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "public, max-age=3600, immutable", rw.Header().Get("Cache-Control"))
+}
+
+func TestReturns304WhenETagMatches(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abc")}, nil)
+
+	r.Header.Set("If-None-Match", `"other", W/"ba7816bf8f01cfea414140de5dae2223"`)
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusNotModified, rw.Code)
+	assert.Empty(t, rw.Body.String())
+	assert.NotEmpty(t, rw.Header().Get("ETag"))
+}
+
+func TestReturns200WhenETagDoesNotMatch(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abc")}, nil)
+
+	r.Header.Set("If-None-Match", `"other"`)
+	r.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "abc", rw.Body.String())
+}
+
+func TestReturns304WhenNotModifiedSince(t *testing.T) {
+	_, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abc")}, nil)
+
+	first := httptest.NewRecorder()
+	h.ServeHTTP(first, r)
+
+	rw := httptest.NewRecorder()
+	r.Header.Set("If-Modified-Since", first.Header().Get("Last-Modified"))
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusNotModified, rw.Code)
+}
+
+func TestModTimesAreKeyedByContent(t *testing.T) {
+	m := newModTimes(2)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	first := m.get("a")
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, first, m.get("a"))
+	assert.Equal(t, now, m.get("b"))
+
+	// the times are forgotten when the limit is reached
+	m.get("c")
+	assert.Len(t, m.times, 1)
+	assert.Equal(t, now, m.get("a"))
+}
+
+func TestReturns206WhenRangeRequested(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abcdef")}, nil)
+
+	r.Header.Set("Range", "bytes=2-3")
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusPartialContent, rw.Code)
+	assert.Equal(t, "cd", rw.Body.String())
+	assert.Equal(t, "bytes 2-3/6", rw.Header().Get("Content-Range"))
+	assert.Equal(t, "bytes", rw.Header().Get("Accept-Ranges"))
+}
+
+func TestReturnsFullImageWhenIfRangeDoesNotMatch(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abcdef")}, nil)
+
+	r.Header.Set("Range", "bytes=2-3")
+	r.Header.Set("If-Range", `"other"`)
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "abcdef", rw.Body.String())
+}
+
+func TestReturns206WhenIfRangeMatches(t *testing.T) {
+	_, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abcdef")}, nil)
+
+	first := httptest.NewRecorder()
+	h.ServeHTTP(first, r)
+
+	rw := httptest.NewRecorder()
+	r.Header.Set("Range", "bytes=4-")
+	r.Header.Set("If-Range", first.Header().Get("ETag"))
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusPartialContent, rw.Code)
+	assert.Equal(t, "ef", rw.Body.String())
+}
+
+func TestReturns416WhenRangeNotSatisfiable(t *testing.T) {
+	rw, r, h := setupCacheHandler()
+	mockCache.On("Get", mock.Anything, mock.Anything, mock.Anything).Return(&cache.CacheItem{Data: []byte("abcdef")}, nil)
+
+	r.Header.Set("Range", "bytes=10-20")
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rw.Code)
+}
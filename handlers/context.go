@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/emojify-app/api/breaker"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// upstreamContext returns a context for calling an upstream service derived
+// from the inbound request, the context is cancelled when the client
+// disconnects or when the timeout expires. A timeout of 0 disables the
+// deadline.
+func upstreamContext(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// errShuttingDown is the cause of streams cancelled by the server shutting
+// down
+var errShuttingDown = errors.New("server is shutting down")
+
+type shutdownContextKey struct{}
+
+// WithShutdown returns a copy of ctx which carries shutdown, set it as the
+// BaseContext of the http.Server and cancel shutdown when the server begins
+// shutting down. Long-lived streams end when shutdown is cancelled, other
+// requests are not cancelled so they can complete while the server drains.
+func WithShutdown(ctx, shutdown context.Context) context.Context {
+	return context.WithValue(ctx, shutdownContextKey{}, shutdown)
+}
+
+// streamContext returns a context for a long-lived stream derived from the
+// inbound request, the context is also cancelled when the server begins
+// shutting down
+func streamContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+
+	shutdown, ok := r.Context().Value(shutdownContextKey{}).(context.Context)
+	if !ok {
+		return ctx, func() { cancel(nil) }
+	}
+
+	stop := context.AfterFunc(shutdown, func() { cancel(errShuttingDown) })
+
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+// isShuttingDown returns true when ctx, or the context it was derived from,
+// was cancelled because the server is shutting down
+func isShuttingDown(ctx context.Context) bool {
+	return context.Cause(ctx) == errShuttingDown
+}
+
+// isDeadlineExceeded returns true when the error was caused by an upstream
+// call exceeding its deadline
+func isDeadlineExceeded(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if err == context.DeadlineExceeded {
+		return true
+	}
+
+	return status.Code(err) == codes.DeadlineExceeded
+}
+
+// isCircuitOpen returns true when the call was rejected by the circuit breaker
+// for the upstream
+func isCircuitOpen(err error) bool {
+	return err == breaker.ErrOpen
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/emojify-app/api/logging"
+)
+
+// BatchConfig configures the EmojifyBatch handler
+type BatchConfig struct {
+	// MaxSize is the maximum number of URLs in a batch
+	MaxSize int
+	// Concurrency is the maximum number of concurrent calls to the emojify
+	// service for a single batch
+	Concurrency int
+}
+
+// BatchResult is the result for a single URL in a batch
+type BatchResult struct {
+	URL    string           `json:"url"`
+	Status int              `json:"status"`
+	Job    *EmojifyResponse `json:"job,omitempty"`
+	Error  *ErrorResponse   `json:"error,omitempty"`
+}
+
+// EmojifyBatch is a http.Handler which creates emojify jobs for a list of
+// URLs
+type EmojifyBatch struct {
+	logger logging.Logger
+	post   *EmojifyPost
+	config BatchConfig
+}
+
+// NewEmojifyBatch returns a new instance of the EmojifyBatch handler, jobs are
+// created using the upstream, timeout and URL policy of post
+func NewEmojifyBatch(l logging.Logger, post *EmojifyPost, config BatchConfig) *EmojifyBatch {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+
+	return &EmojifyBatch{l, post, config}
+}
+
+// ServeHTTP implements the handler function, the body must be a JSON array of
+// URLs. The response is an array of BatchResult in the same order as the
+// request with the status 200 when every job was created or 207 when any job
+// failed.
+func (e *EmojifyBatch) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	done := e.logger.WithContext(r.Context()).EmojifyHandlerBatchCalled(r)
+
+	var urls []string
+	if r.Body == nil {
+		err := fmt.Errorf("missing request payload")
+		writeError(rw, r, http.StatusBadRequest, err.Error(), nil)
+		done(http.StatusBadRequest, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(rw, r.Body, e.post.uploads.MaxSize)
+	if err := json.NewDecoder(r.Body).Decode(&urls); err != nil {
+		rerr := bodyError(err, "body must be a JSON array of URLs")
+		writeError(rw, r, rerr.Code, rerr.Error(), nil)
+		done(rerr.Code, rerr)
+		return
+	}
+
+	if len(urls) == 0 || len(urls) > e.config.MaxSize {
+		err := fmt.Errorf("batch must contain between 1 and %d URLs", e.config.MaxSize)
+		writeError(rw, r, http.StatusBadRequest, err.Error(), nil)
+		done(http.StatusBadRequest, err)
+		return
+	}
+
+	results := make([]BatchResult, len(urls))
+	sem := make(chan struct{}, e.config.Concurrency)
+	var wg sync.WaitGroup
+
+	for i, u := range urls {
+		// the request counts as the first job, each other job is charged to
+		// the rate limit of the client
+		if i > 0 && !takeRateLimit(r) {
+			results[i] = BatchResult{
+				URL:    u,
+				Status: http.StatusTooManyRequests,
+				Error:  newErrorResponse(r, http.StatusTooManyRequests, "rate limit exceeded", nil),
+			}
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, u string) {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = e.create(r, u)
+		}(i, u)
+	}
+
+	wg.Wait()
+
+	st := http.StatusOK
+	for _, res := range results {
+		if res.Error != nil {
+			st = http.StatusMultiStatus
+			break
+		}
+	}
+
+	e.post.setQuotaHeader(rw, r)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(st)
+	json.NewEncoder(rw).Encode(results)
+
+	done(st, nil)
+}
+
+func (e *EmojifyBatch) create(r *http.Request, uri string) BatchResult {
+	res := BatchResult{URL: uri}
+
+	if st, err := e.post.checkQuota(r); err != nil {
+		res.Status = st
+		res.Error = newErrorResponse(r, st, createJobErrorMessage(st), err)
+		return res
+	}
+
+	u, err := e.post.validateURL(r.Context(), []byte(uri))
+	if err != nil {
+		res.Status = http.StatusBadRequest
+		res.Error = newErrorResponse(r, res.Status, err.Error(), nil)
+		return res
+	}
+
+	qi, st, err := e.post.createJob(r, u.String(), nil, "")
+	res.Status = st
+	if err != nil {
+		res.Error = newErrorResponse(r, st, createJobErrorMessage(st), err)
+		return res
+	}
+
+	job := EmojifyResponse{}.FromQueryItem(qi)
+	res.Job = &job
+
+	return res
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/emojify-app/api/logging"
+)
+
+// maxBatchIDsSize is the maximum size in bytes of the body for POST requests
+const maxBatchIDsSize = 1 << 20
+
+// BatchQueryResponse is returned by the EmojifyBatchGet handler, every
+// requested id is present in either Jobs or Errors
+type BatchQueryResponse struct {
+	Jobs   map[string]*EmojifyResponse `json:"jobs"`
+	Errors map[string]*ErrorResponse   `json:"errors"`
+}
+
+// EmojifyBatchGet is a http.Handler for querying the state of multiple jobs
+type EmojifyBatchGet struct {
+	logger logging.Logger
+	get    *EmojifyGet
+	config BatchConfig
+}
+
+// NewEmojifyBatchGet returns a new instance of the EmojifyBatchGet handler,
+// jobs are queried using the upstream and timeout of get
+func NewEmojifyBatchGet(l logging.Logger, get *EmojifyGet, config BatchConfig) *EmojifyBatchGet {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+
+	return &EmojifyBatchGet{l, get, config}
+}
+
+// ServeHTTP implements the handler function, ids are read from the comma
+// separated query parameter ids for GET requests or from a JSON array in the
+// body for POST requests. The status is 200 when every job was found or 207
+// when any query failed.
+func (e *EmojifyBatchGet) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	done := e.logger.WithContext(r.Context()).EmojifyHandlerBatchGETCalled(r)
+
+	ids, rerr := e.readIDs(rw, r)
+	if rerr != nil {
+		writeError(rw, r, rerr.Code, rerr.Error(), nil)
+		done(rerr.Code, rerr)
+		return
+	}
+
+	resp := &BatchQueryResponse{
+		Jobs:   map[string]*EmojifyResponse{},
+		Errors: map[string]*ErrorResponse{},
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, e.config.Concurrency)
+
+	for _, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(id string) {
+			defer func() { <-sem; wg.Done() }()
+
+			qi, st, err := e.get.queryJob(r, id)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err != nil {
+				resp.Errors[id] = newErrorResponse(r, st, queryJobErrorMessage(st), err)
+				return
+			}
+
+			job := EmojifyResponse{}.FromQueryItem(qi)
+			resp.Jobs[id] = &job
+		}(id)
+	}
+
+	wg.Wait()
+
+	st := http.StatusOK
+	if len(resp.Errors) > 0 {
+		st = http.StatusMultiStatus
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(st)
+	json.NewEncoder(rw).Encode(resp)
+
+	done(st, nil)
+}
+
+// readIDs returns the unique ids from the request
+func (e *EmojifyBatchGet) readIDs(rw http.ResponseWriter, r *http.Request) ([]string, *requestError) {
+	var raw []string
+
+	if r.Method == http.MethodPost {
+		if r.Body == nil {
+			return nil, newRequestError(http.StatusBadRequest, "missing request payload")
+		}
+
+		r.Body = http.MaxBytesReader(rw, r.Body, maxBatchIDsSize)
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			return nil, bodyError(err, "body must be a JSON array of ids")
+		}
+	} else {
+		raw = strings.Split(r.URL.Query().Get("ids"), ",")
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, id := range raw {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 || len(ids) > e.config.MaxSize {
+		return nil, newRequestError(http.StatusBadRequest, "request must contain between 1 and %d ids", e.config.MaxSize)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func setupEmojifyBatchGetHandler() (*httptest.ResponseRecorder, *EmojifyBatchGet, *emojify.ClientMock) {
+	ec := &emojify.ClientMock{}
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	h := NewEmojifyBatchGet(logger, NewEmojifyGet(logger, ec, 0, nil), BatchConfig{MaxSize: 3, Concurrency: 2})
+
+	return httptest.NewRecorder(), h, ec
+}
+
+func TestBatchGetReturnsBadRequestWhenNoIDs(t *testing.T) {
+	rw, h, _ := setupEmojifyBatchGetHandler()
+	r := httptest.NewRequest("GET", "/emojify?ids=,", nil)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestBatchGetReturnsBadRequestWhenTooManyIDs(t *testing.T) {
+	rw, h, _ := setupEmojifyBatchGetHandler()
+	r := httptest.NewRequest("GET", "/emojify?ids=a,b,c,d", nil)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestBatchGetReturnsJobsWhenAllFound(t *testing.T) {
+	rw, h, ec := setupEmojifyBatchGetHandler()
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(1, emojify.QueryStatus_QUEUED), nil)
+	r := httptest.NewRequest("GET", "/emojify?ids=a,b,a", nil)
+
+	h.ServeHTTP(rw, r)
+
+	resp := BatchQueryResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &resp)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Len(t, resp.Jobs, 2)
+	assert.Len(t, resp.Errors, 0)
+	ec.AssertNumberOfCalls(t, "Query", 2)
+}
+
+func TestBatchGetReportsMissingIDsIndividually(t *testing.T) {
+	rw, h, ec := setupEmojifyBatchGetHandler()
+	ec.On("Query", mock.Anything, &wrappers.StringValue{Value: "a"}, mock.Anything).Return(queryItem(1, emojify.QueryStatus_QUEUED), nil)
+	ec.On("Query", mock.Anything, &wrappers.StringValue{Value: "b"}, mock.Anything).Return(nil, status.Error(codes.NotFound, "missing"))
+
+	body := ioutil.NopCloser(bytes.NewBufferString(`["a","b"]`))
+	r := httptest.NewRequest("POST", "/emojify/status", body)
+
+	h.ServeHTTP(rw, r)
+
+	resp := BatchQueryResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &resp)
+
+	assert.Equal(t, http.StatusMultiStatus, rw.Code)
+	assert.Contains(t, resp.Jobs, "a")
+	assert.Equal(t, http.StatusNotFound, resp.Errors["b"].Code)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func setupEmojifyBatchHandler(body string) (*httptest.ResponseRecorder, *http.Request, *EmojifyBatch, *emojify.ClientMock) {
+	ec := &emojify.ClientMock{}
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	post := NewEmojifyPost(logger, ec, 0, ImageUploads{MaxSize: 1024}, testURLPolicy(), Idempotency{}, nil, nil)
+	h := NewEmojifyBatch(logger, post, BatchConfig{MaxSize: 3, Concurrency: 2})
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/emojify/batch", ioutil.NopCloser(bytes.NewBufferString(body)))
+
+	return rw, r, h, ec
+}
+
+func TestBatchReturnsBadRequestWhenBodyNotArray(t *testing.T) {
+	rw, r, h, _ := setupEmojifyBatchHandler(`{"url":"http://a.com"}`)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestBatchReturnsBadRequestWhenTooManyURLs(t *testing.T) {
+	rw, r, h, _ := setupEmojifyBatchHandler(`["http://a.com/1","http://a.com/2","http://a.com/3","http://a.com/4"]`)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestBatchReturnsOKWhenAllCreated(t *testing.T) {
+	rw, r, h, ec := setupEmojifyBatchHandler(`["http://a.com/1","http://a.com/2"]`)
+	ec.On("Create", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(1, emojify.QueryStatus_QUEUED), nil)
+
+	h.ServeHTTP(rw, r)
+
+	results := []BatchResult{}
+	json.Unmarshal(rw.Body.Bytes(), &results)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Len(t, results, 2)
+	assert.Equal(t, "http://a.com/2", results[1].URL)
+	assert.Equal(t, "abc123", results[1].Job.ID)
+	ec.AssertNumberOfCalls(t, "Create", 2)
+}
+
+func TestBatchDoesNotForwardIdempotencyKey(t *testing.T) {
+	rw, r, h, ec := setupEmojifyBatchHandler(`["http://a.com/1","http://a.com/2"]`)
+	r.Header.Set(IdempotencyKeyHeader, "key123")
+	ec.On("Create", forwardedIdempotencyKey(""), mock.Anything, mock.Anything).Return(queryItem(1, emojify.QueryStatus_QUEUED), nil)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	ec.AssertNumberOfCalls(t, "Create", 2)
+}
+
+func TestBatchChargesRateLimitForEachJob(t *testing.T) {
+	rw, r, h, ec := setupEmojifyBatchHandler(`["http://a.com/1","http://a.com/2","http://a.com/3"]`)
+	ec.On("Create", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(1, emojify.QueryStatus_QUEUED), nil)
+
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+	rl, _ := NewRateLimiter(logger, "emojify", RateLimit{Rate: 0.001, Burst: 2, Key: RateLimitKeyIP})
+
+	rl.Middleware(h).ServeHTTP(rw, r)
+
+	results := []BatchResult{}
+	json.Unmarshal(rw.Body.Bytes(), &results)
+
+	assert.Equal(t, http.StatusMultiStatus, rw.Code)
+	assert.Equal(t, http.StatusOK, results[1].Status)
+	assert.Equal(t, http.StatusTooManyRequests, results[2].Status)
+	ec.AssertNumberOfCalls(t, "Create", 2)
+}
+
+func TestBatchReturnsMultiStatusWhenPartialFailure(t *testing.T) {
+	rw, r, h, ec := setupEmojifyBatchHandler(`["http://a.com/1","not a url","http://a.com/3"]`)
+	ec.On("Create", mock.Anything, &wrappers.StringValue{Value: "http://a.com/1"}, mock.Anything).Return(queryItem(1, emojify.QueryStatus_QUEUED), nil)
+	ec.On("Create", mock.Anything, &wrappers.StringValue{Value: "http://a.com/3"}, mock.Anything).Return(nil, status.Error(codes.Internal, "boom"))
+
+	h.ServeHTTP(rw, r)
+
+	results := []BatchResult{}
+	json.Unmarshal(rw.Body.Bytes(), &results)
+
+	assert.Equal(t, http.StatusMultiStatus, rw.Code)
+	assert.Equal(t, http.StatusOK, results[0].Status)
+	assert.Equal(t, http.StatusBadRequest, results[1].Status)
+	assert.Equal(t, http.StatusInternalServerError, results[2].Status)
+	assert.Equal(t, "Internal", results[2].Error.Upstream.Code)
+}
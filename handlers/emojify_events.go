@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// minEventInterval is the shortest delay between polls so a misconfigured
+// interval can not poll the emojify service in a tight loop
+const minEventInterval = 10 * time.Millisecond
+
+// EventPolling configures how often the emojify service is polled when
+// streaming job events
+type EventPolling struct {
+	// MinInterval is the delay between polls after the job state changes
+	MinInterval time.Duration
+	// MaxInterval is the maximum delay between polls, the delay doubles each
+	// time the job state is unchanged
+	MaxInterval time.Duration
+	// Timeout is the maximum duration of a stream, 0 streams until the job
+	// has finished or the client disconnects
+	Timeout time.Duration
+}
+
+// EmojifyEvents is a http.Handler which streams the state of an emojify job
+// as Server-Sent Events until the job has finished
+type EmojifyEvents struct {
+	logger  logging.Logger
+	emojify emojify.EmojifyClient
+	timeout time.Duration
+	polling EventPolling
+	jobs    JobStore
+}
+
+// NewEmojifyEvents returns a new instance of the EmojifyEvents handler,
+// timeout is the maximum duration to wait for each query to the emojify
+// service. Jobs recorded in jobs can only be streamed by their owners. Poll
+// intervals shorter than 10ms are increased to 10ms.
+func NewEmojifyEvents(l logging.Logger, e emojify.EmojifyClient, timeout time.Duration, polling EventPolling, jobs JobStore) *EmojifyEvents {
+	if polling.MinInterval < minEventInterval {
+		polling.MinInterval = minEventInterval
+	}
+
+	if polling.MaxInterval < polling.MinInterval {
+		polling.MaxInterval = polling.MinInterval
+	}
+
+	return &EmojifyEvents{l, e, timeout, polling, jobs}
+}
+
+// ServeHTTP implements the handler function
+func (e *EmojifyEvents) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	done := e.logger.WithContext(r.Context()).EmojifyHandlerEventsCalled(r)
+
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		done(http.StatusBadRequest, nil)
+
+		writeError(rw, r, http.StatusBadRequest, "id is a required parameter", nil)
+		return
+	}
+
+	if !canAccessJob(e.jobs, r, id) {
+		e.logger.WithContext(r.Context()).JobAccessDenied(id)
+		done(http.StatusNotFound, errJobNotOwned)
+
+		writeError(rw, r, http.StatusNotFound, "emojify job not found", nil)
+		return
+	}
+
+	f, ok := rw.(http.Flusher)
+	if !ok {
+		err := fmt.Errorf("response writer does not support streaming")
+		done(http.StatusInternalServerError, err)
+
+		writeError(rw, r, http.StatusInternalServerError, "streaming is not supported", nil)
+		return
+	}
+
+	// the stream ends when the server begins shutting down
+	sctx, scancel := streamContext(r)
+	defer scancel()
+
+	ctx, cancel := upstreamContext(r.WithContext(sctx), e.polling.Timeout)
+	defer cancel()
+
+	// queries are made with the context of the stream
+	sr := r.WithContext(ctx)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	var last *EmojifyResponse
+	interval := e.polling.MinInterval
+
+	for {
+		resp, err := e.query(sr, id)
+
+		switch {
+		case ctx.Err() != nil:
+			// the client has gone away, the server is shutting down or the
+			// stream has timed out
+			switch {
+			case r.Context().Err() != nil:
+			case isShuttingDown(ctx):
+				writeEvent(rw, f, "shutdown", newErrorResponse(r, http.StatusServiceUnavailable, "server is shutting down", nil))
+			default:
+				writeEvent(rw, f, "timeout", newErrorResponse(r, http.StatusGatewayTimeout, "timeout waiting for job to finish", nil))
+			}
+
+			done(http.StatusOK, nil)
+			return
+
+		case status.Code(err) == codes.NotFound:
+			writeEvent(rw, f, "error", newErrorResponse(r, http.StatusNotFound, "emojify job not found", err))
+
+			done(http.StatusNotFound, err)
+			return
+
+		case err != nil:
+			// transient errors are retried with backoff
+
+		case last == nil || *last != *resp:
+			writeEvent(rw, f, "status", resp)
+			last = resp
+			interval = e.polling.MinInterval
+
+			if resp.Status == emojify.QueryStatus_FINISHED.String() {
+				done(http.StatusOK, nil)
+				return
+			}
+
+			e.wait(ctx, interval)
+			continue
+		}
+
+		// state is unchanged, back off before the next poll
+		interval = interval * 2
+		if interval > e.polling.MaxInterval {
+			interval = e.polling.MaxInterval
+		}
+
+		e.wait(ctx, interval)
+	}
+}
+
+func (e *EmojifyEvents) query(r *http.Request, id string) (*EmojifyResponse, error) {
+	qDone := e.logger.WithContext(r.Context()).EmojifyHandlerCallQuery(id)
+
+	ctx, cancel := upstreamContext(r, e.timeout)
+	defer cancel()
+
+	qi, err := e.emojify.Query(ctx, &wrappers.StringValue{Value: id})
+	if err != nil {
+		qDone(http.StatusInternalServerError, err)
+		return nil, err
+	}
+
+	qDone(http.StatusOK, nil)
+
+	resp := EmojifyResponse{}.FromQueryItem(qi)
+	return &resp, nil
+}
+
+func (e *EmojifyEvents) wait(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// writeEvent writes a Server-Sent Event with a JSON payload
+func writeEvent(rw http.ResponseWriter, f http.Flusher, event string, v interface{}) {
+	data, _ := json.Marshal(v)
+
+	fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event, data)
+	f.Flush()
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func queryItem(pos int32, s emojify.QueryStatus_QueryStatus) *emojify.QueryItem {
+	return &emojify.QueryItem{
+		Id:            "abc123",
+		QueuePosition: pos,
+		QueueLength:   4,
+		Status:        &emojify.QueryStatus{Status: s},
+	}
+}
+
+func setupEmojifyEventsHandler() (*httptest.ResponseRecorder, *http.Request, *EmojifyEvents, *emojify.ClientMock) {
+	ec := &emojify.ClientMock{}
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	r := httptest.NewRequest("GET", "/emojify/abc123/events", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "abc123"})
+	rw := httptest.NewRecorder()
+
+	h := NewEmojifyEvents(logger, ec, 0, EventPolling{
+		MinInterval: minEventInterval,
+		MaxInterval: 2 * minEventInterval,
+		Timeout:     100 * time.Millisecond,
+	}, nil)
+
+	return rw, r, h, ec
+}
+
+func TestEventsStreamsChangesUntilFinished(t *testing.T) {
+	rw, r, h, ec := setupEmojifyEventsHandler()
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(2, emojify.QueryStatus_QUEUED), nil).Times(3)
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(1, emojify.QueryStatus_QUEUED), nil).Once()
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(0, emojify.QueryStatus_FINISHED), nil).Once()
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "text/event-stream", rw.Header().Get("Content-Type"))
+	assert.Equal(t, 3, strings.Count(rw.Body.String(), "event: status\n"))
+	assert.Contains(t, rw.Body.String(), `"status":"FINISHED"`)
+	ec.AssertNumberOfCalls(t, "Query", 5)
+}
+
+func TestEventsSendsErrorWhenNotFound(t *testing.T) {
+	rw, r, h, ec := setupEmojifyEventsHandler()
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(nil, status.Error(codes.NotFound, "missing"))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Contains(t, rw.Body.String(), "event: error\n")
+}
+
+func TestEventsSendsTimeoutWhenNotFinished(t *testing.T) {
+	rw, r, h, ec := setupEmojifyEventsHandler()
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(2, emojify.QueryStatus_QUEUED), nil)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, 1, strings.Count(rw.Body.String(), "event: status\n"))
+	assert.Contains(t, rw.Body.String(), "event: timeout\n")
+}
+
+func TestEventsSendsShutdownWhenServerShuttingDown(t *testing.T) {
+	rw, r, h, ec := setupEmojifyEventsHandler()
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(2, emojify.QueryStatus_QUEUED), nil)
+
+	shutdown, cancel := context.WithCancel(context.Background())
+	r = r.WithContext(WithShutdown(r.Context(), shutdown))
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Contains(t, rw.Body.String(), "event: shutdown\n")
+	assert.NotContains(t, rw.Body.String(), "event: timeout\n")
+}
+
+func TestNewEmojifyEventsClampsPollInterval(t *testing.T) {
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	h := NewEmojifyEvents(logger, &emojify.ClientMock{}, 0, EventPolling{}, nil)
+
+	assert.Equal(t, minEventInterval, h.polling.MinInterval)
+	assert.Equal(t, minEventInterval, h.polling.MaxInterval)
+}
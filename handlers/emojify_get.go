@@ -1,8 +1,8 @@
 package handlers
 
 import (
-	"context"
 	"net/http"
+	"time"
 
 	"github.com/emojify-app/api/logging"
 	"github.com/emojify-app/emojify/protos/emojify"
@@ -14,16 +14,21 @@ import (
 type EmojifyGet struct {
 	logger  logging.Logger
 	emojify emojify.EmojifyClient
+	timeout time.Duration
+	jobs    JobStore
 }
 
-// NewEmojifyGet returns a new instance of the Emojify handler
-func NewEmojifyGet(l logging.Logger, e emojify.EmojifyClient) *EmojifyGet {
-	return &EmojifyGet{l, e}
+// NewEmojifyGet returns a new instance of the Emojify handler, timeout is the
+// maximum duration to wait for the emojify service. Jobs recorded in jobs
+// can only be queried by their owners, a nil store allows any job to be
+// queried.
+func NewEmojifyGet(l logging.Logger, e emojify.EmojifyClient, timeout time.Duration, jobs JobStore) *EmojifyGet {
+	return &EmojifyGet{l, e, timeout, jobs}
 }
 
 // ServeHTTP implements the handler function
 func (e *EmojifyGet) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	done := e.logger.EmojifyHandlerGETCalled(r)
+	done := e.logger.WithContext(r.Context()).EmojifyHandlerGETCalled(r)
 
 	vars := mux.Vars(r) // Get varaibles from the request path
 
@@ -32,24 +37,66 @@ func (e *EmojifyGet) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	if id == "" {
 		done(http.StatusBadRequest, nil)
 
-		rw.WriteHeader(http.StatusBadRequest)
+		writeError(rw, r, http.StatusBadRequest, "id is a required parameter", nil)
 		return
 	}
 
+	qi, st, err := e.queryJob(r, id)
+	if err != nil {
+		done(st, err)
+
+		writeError(rw, r, st, queryJobErrorMessage(st), err)
+		return
+	}
+
+	EmojifyResponse{}.FromQueryItem(qi).WriteJSON(rw)
+	done(http.StatusOK, nil)
+}
+
+// queryJob calls the emojify service to query the job with the given id, the
+// returned status is the HTTP status code for the result. Jobs owned by
+// another client are reported as not found.
+func (e *EmojifyGet) queryJob(r *http.Request, id string) (*emojify.QueryItem, int, error) {
+	if !canAccessJob(e.jobs, r, id) {
+		e.logger.WithContext(r.Context()).JobAccessDenied(id)
+		return nil, http.StatusNotFound, errJobNotOwned
+	}
+
+	qDone := e.logger.WithContext(r.Context()).EmojifyHandlerCallQuery(id)
+	ctx, cancel := upstreamContext(r, e.timeout)
+	defer cancel()
+
+	qi, err := e.emojify.Query(ctx, &wrappers.StringValue{Value: id})
+	if isCircuitOpen(err) {
+		qDone(http.StatusServiceUnavailable, err)
+		return nil, http.StatusServiceUnavailable, err
+	}
+
+	if isDeadlineExceeded(err) {
+		qDone(http.StatusGatewayTimeout, err)
+		return nil, http.StatusGatewayTimeout, err
+	}
+
 	// errors from the emojify api should be treated like 404, could just be a
 	// queue or cache item missing
-	qDone := e.logger.EmojifyHandlerCallQuery(id)
-	qi, err := e.emojify.Query(context.Background(), &wrappers.StringValue{Value: id})
 	if err != nil {
 		qDone(http.StatusInternalServerError, err)
-		done(http.StatusInternalServerError, err)
-
-		rw.WriteHeader(http.StatusNotFound)
-		return
+		return nil, http.StatusNotFound, err
 	}
 
 	qDone(http.StatusOK, nil)
+	return qi, http.StatusOK, nil
+}
 
-	EmojifyResponse{}.FromQueryItem(qi).WriteJSON(rw)
-	done(http.StatusOK, nil)
+// queryJobErrorMessage returns the message for the client when queryJob fails
+// with the given status
+func queryJobErrorMessage(status int) string {
+	switch status {
+	case http.StatusGatewayTimeout:
+		return "timeout querying emojify service"
+	case http.StatusServiceUnavailable:
+		return "emojify service is unavailable"
+	}
+
+	return "emojify job not found"
 }
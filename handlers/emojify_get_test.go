@@ -6,12 +6,17 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/breaker"
 	"github.com/emojify-app/api/logging"
 	"github.com/emojify-app/emojify/protos/emojify"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func setupEmojiGetHandler(id string) (*httptest.ResponseRecorder, *http.Request, *EmojifyGet) {
@@ -32,7 +37,7 @@ func setupEmojiGetHandler(id string) (*httptest.ResponseRecorder, *http.Request,
 		nil,
 	)
 
-	logger, _ := logging.New("test", "test", "localhost:8125", "error", "text")
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
 
 	// Set the gorilla mux vars for testing
 	r := httptest.NewRequest("GET", "/", nil)
@@ -41,7 +46,7 @@ func setupEmojiGetHandler(id string) (*httptest.ResponseRecorder, *http.Request,
 	}
 	rw := httptest.NewRecorder()
 
-	h := NewEmojifyGet(logger, &mockEmojifyer)
+	h := NewEmojifyGet(logger, &mockEmojifyer, 0, nil)
 
 	return rw, r, h
 }
@@ -72,6 +77,20 @@ func TestGetReturns404ErrorWhenCacheError(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, rr.Code)
 }
 
+func TestGetReturns503WhenCircuitOpen(t *testing.T) {
+	rr, r, e := setupEmojiGetHandler("abc123")
+	resetEmojifyMock()
+	mockEmojifyer.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(nil, breaker.ErrOpen)
+
+	e.ServeHTTP(rr, r)
+
+	er := ErrorResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &er)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "emojify service is unavailable", er.Message)
+}
+
 func TestGetReturnsQueueItemWhenOk(t *testing.T) {
 	rr, r, e := setupEmojiGetHandler("abc123")
 
@@ -83,3 +102,46 @@ func TestGetReturnsQueueItemWhenOk(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code)
 	assert.Equal(t, int32(2), er.Position)
 }
+
+func TestGetReturns504WhenDeadlineExceeded(t *testing.T) {
+	rr, r, e := setupEmojiGetHandler("abc123")
+	resetEmojifyMock()
+	mockEmojifyer.On(
+		"Query",
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+	).Return(
+		nil,
+		status.Error(codes.DeadlineExceeded, "timeout"),
+	)
+
+	e.ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+}
+
+func TestGetReturns404WhenJobOwnedByAnotherClient(t *testing.T) {
+	rr, r, e := setupEmojiGetHandler("abc123")
+	jobs := NewMemoryJobStore(time.Hour, 10)
+	jobs.Add("nic", Job{ID: "abc123"})
+	e.jobs = jobs
+
+	r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: "erik"}))
+	e.ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	mockEmojifyer.AssertNotCalled(t, "Query", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestGetReturnsJobToOwner(t *testing.T) {
+	rr, r, e := setupEmojiGetHandler("abc123")
+	jobs := NewMemoryJobStore(time.Hour, 10)
+	jobs.Add("nic", Job{ID: "abc123"})
+	e.jobs = jobs
+
+	r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: "nic"}))
+	e.ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
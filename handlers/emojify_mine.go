@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/logging"
+)
+
+// defaultMineLimit is the number of jobs listed when the request does not
+// contain a limit
+const defaultMineLimit = 20
+
+// JobResponse is the state of a job created by the client, Error is set when
+// the job could not be queried
+type JobResponse struct {
+	EmojifyResponse
+	Created time.Time      `json:"created"`
+	Error   *ErrorResponse `json:"error,omitempty"`
+}
+
+// EmojifyMine is a http.Handler which lists the most recent jobs created by
+// the authenticated client
+type EmojifyMine struct {
+	logger logging.Logger
+	get    *EmojifyGet
+	jobs   JobStore
+	config BatchConfig
+}
+
+// NewEmojifyMine returns a new instance of the EmojifyMine handler, jobs are
+// queried using the upstream and timeout of get. At most config.MaxSize jobs
+// are listed.
+func NewEmojifyMine(l logging.Logger, get *EmojifyGet, jobs JobStore, config BatchConfig) *EmojifyMine {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+
+	return &EmojifyMine{l, get, jobs, config}
+}
+
+// ServeHTTP implements the handler function, the number of jobs is set with
+// the query parameter limit
+func (e *EmojifyMine) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	done := e.logger.WithContext(r.Context()).EmojifyHandlerMineCalled(r)
+
+	subject := auth.SubjectFromContext(r.Context())
+	if subject == "" {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="emojify"`)
+		writeError(rw, r, http.StatusUnauthorized, "authentication required", nil)
+		done(http.StatusUnauthorized, nil)
+		return
+	}
+
+	limit := defaultMineLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > e.config.MaxSize {
+			rerr := newRequestError(http.StatusBadRequest, "limit must be between 1 and %d", e.config.MaxSize)
+			writeError(rw, r, rerr.Code, rerr.Error(), nil)
+			done(rerr.Code, rerr)
+			return
+		}
+	} else if limit > e.config.MaxSize {
+		limit = e.config.MaxSize
+	}
+
+	jobs := e.jobs.List(subject, limit)
+	resp := make([]JobResponse, len(jobs))
+
+	sem := make(chan struct{}, e.config.Concurrency)
+	var wg sync.WaitGroup
+
+	for i, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, j Job) {
+			defer func() { <-sem; wg.Done() }()
+
+			resp[i] = JobResponse{EmojifyResponse: EmojifyResponse{ID: j.ID}, Created: j.Created}
+
+			qi, st, err := e.get.queryJob(r, j.ID)
+			if err != nil {
+				resp[i].Error = newErrorResponse(r, st, queryJobErrorMessage(st), err)
+				return
+			}
+
+			resp[i].EmojifyResponse = EmojifyResponse{}.FromQueryItem(qi)
+		}(i, j)
+	}
+
+	wg.Wait()
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(resp)
+
+	done(http.StatusOK, nil)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func setupEmojifyMineHandler() (*EmojifyMine, *MemoryJobStore, *emojify.ClientMock) {
+	ec := &emojify.ClientMock{}
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+	jobs := NewMemoryJobStore(time.Hour, 10)
+
+	h := NewEmojifyMine(logger, NewEmojifyGet(logger, ec, 0, jobs), jobs, BatchConfig{MaxSize: 3, Concurrency: 2})
+
+	return h, jobs, ec
+}
+
+func mineRequest(h http.Handler, subject, query string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/emojify/mine"+query, nil)
+	if subject != "" {
+		r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: subject}))
+	}
+
+	h.ServeHTTP(rw, r)
+
+	return rw
+}
+
+func TestMineReturns401WhenAnonymous(t *testing.T) {
+	h, _, _ := setupEmojifyMineHandler()
+
+	rw := mineRequest(h, "", "")
+
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
+
+func TestMineReturns400WhenLimitInvalid(t *testing.T) {
+	h, _, _ := setupEmojifyMineHandler()
+
+	assert.Equal(t, http.StatusBadRequest, mineRequest(h, "nic", "?limit=0").Code)
+	assert.Equal(t, http.StatusBadRequest, mineRequest(h, "nic", "?limit=4").Code)
+	assert.Equal(t, http.StatusBadRequest, mineRequest(h, "nic", "?limit=abc").Code)
+}
+
+func TestMineListsJobsOfClientWithStatus(t *testing.T) {
+	h, jobs, ec := setupEmojifyMineHandler()
+	jobs.Add("nic", Job{ID: "a"})
+	jobs.Add("nic", Job{ID: "b"})
+	jobs.Add("erik", Job{ID: "c"})
+
+	ec.On("Query", mock.Anything, &wrappers.StringValue{Value: "a"}, mock.Anything).Return(queryItem(0, emojify.QueryStatus_FINISHED), nil)
+	ec.On("Query", mock.Anything, &wrappers.StringValue{Value: "b"}, mock.Anything).Return(nil, fmt.Errorf("boom"))
+
+	rw := mineRequest(h, "nic", "")
+
+	var resp []JobResponse
+	json.Unmarshal(rw.Body.Bytes(), &resp)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Len(t, resp, 2)
+	assert.Equal(t, "b", resp[0].ID)
+	assert.Equal(t, http.StatusNotFound, resp[0].Error.Code)
+	assert.Equal(t, "FINISHED", resp[1].Status)
+	assert.Nil(t, resp[1].Error)
+}
+
+func TestPostRecordsOwnerOfJob(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+	jobs := NewMemoryJobStore(time.Hour, 10)
+	h.jobs = jobs
+
+	postAs(h, "nic")
+
+	assert.Len(t, jobs.List("nic", 10), 1)
+}
@@ -3,16 +3,23 @@ package handlers
 import (
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"         // import image
 	_ "image/png" // import image
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
+	"github.com/emojify-app/api/auth"
 	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/api/retry"
+	"github.com/emojify-app/cache/protos/cache"
 	"github.com/emojify-app/emojify/protos/emojify"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"google.golang.org/grpc/metadata"
@@ -46,93 +53,346 @@ func (er EmojifyResponse) WriteJSON(w io.Writer) {
 	e.Encode(&er)
 }
 
+// ImageUploads configures how images uploaded directly to the API are passed
+// to the emojify service. Uploaded images are stored in the cache and the
+// emojify service fetches them from the uploads handler at BaseURL.
+type ImageUploads struct {
+	Cache cache.CacheClient
+	// BaseURL is the URL where the emojify service can reach this API
+	BaseURL string
+	// MaxSize is the maximum size in bytes of a request body
+	MaxSize int64
+	// Timeout is the maximum duration to wait for the cache service
+	Timeout time.Duration
+}
+
 // EmojifyPost is a http.Handler for Emojifying images
 type EmojifyPost struct {
 	logger  logging.Logger
 	emojify emojify.EmojifyClient
+	timeout time.Duration
+	uploads ImageUploads
+	policy  *URLPolicy
+	keys    Idempotency
+	quota   *Quota
+	jobs    JobStore
 }
 
-// NewEmojifyPost returns a new instance of the Emojify handler
-func NewEmojifyPost(l logging.Logger, e emojify.EmojifyClient) *EmojifyPost {
-	return &EmojifyPost{l, e}
+// NewEmojifyPost returns a new instance of the Emojify handler, timeout is the
+// maximum duration to wait for the emojify service and policy restricts the
+// URLs which can be submitted, a nil policy uses DefaultURLPolicy. Responses
+// to requests with an Idempotency-Key header are stored in keys.Store, a nil
+// store ignores the header. Jobs created by authenticated clients are limited
+// by quota, a nil quota is unlimited, and the owner of each job is recorded in
+// jobs.
+func NewEmojifyPost(l logging.Logger, e emojify.EmojifyClient, timeout time.Duration, uploads ImageUploads, policy *URLPolicy, keys Idempotency, quota *Quota, jobs JobStore) *EmojifyPost {
+	if policy == nil {
+		policy = DefaultURLPolicy()
+	}
+
+	if !strings.HasSuffix(uploads.BaseURL, "/") {
+		uploads.BaseURL = uploads.BaseURL + "/"
+	}
+
+	return &EmojifyPost{l, e, timeout, uploads, policy, keys, quota, jobs}
 }
 
 // ServeHTTP implements the handler function
 func (e *EmojifyPost) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	done := e.logger.EmojifyHandlerPOSTCalled(r)
+	done := e.logger.WithContext(r.Context()).EmojifyHandlerPOSTCalled(r)
 
 	// check the post body
-	data, err := e.checkPostBody(r)
-	if err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
-		done(http.StatusBadRequest, err)
+	er, rerr := e.checkPostBody(rw, r)
+	if rerr != nil {
+		resp := newErrorResponse(r, rerr.Code, rerr.Error(), nil)
+		resp.Details = rerr.Details
+		resp.Write(rw, r)
+		done(rerr.Code, rerr)
 		return
 	}
 
-	// validate the url
-	var u *url.URL
-	if u, err = e.validateURL(data); err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
-		done(http.StatusBadRequest, err)
+	// repeated requests with the same idempotency key replay the response of
+	// the first request rather than creating a new job, key is only set when
+	// it has been reserved
+	var key string
+	if k := r.Header.Get(IdempotencyKeyHeader); k != "" && e.keys.Store != nil {
+		if len(k) > maxIdempotencyKeyLength {
+			err := fmt.Errorf("%s must be at most %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength)
+			writeError(rw, r, http.StatusBadRequest, err.Error(), nil)
+			done(http.StatusBadRequest, err)
+			return
+		}
+
+		// keys are scoped to the client so clients which choose the same key
+		// do not share responses
+		key = scopedIdempotencyKey(r, k, e.keys.TrustedProxies)
+		if st, replayed := e.reserveKey(rw, r, key, er); replayed {
+			done(st, nil)
+			return
+		}
+
+		// the key is released if the job is not created so the client can
+		// retry, Release has no effect once the key is complete
+		defer e.keys.Store.Release(key)
+	}
+
+	// the quota is checked before the image is uploaded so a client which has
+	// exceeded its quota can not store images in the cache
+	if st, err := e.checkQuota(r); err != nil {
+		e.setQuotaHeader(rw, r)
+		writeError(rw, r, st, createJobErrorMessage(st), err)
+		done(st, err)
 		return
 	}
 
-	ecDone := e.logger.EmojifyHandlerCallCreate(u.String())
+	var uri string
+	if er.Image != nil {
+		// store the uploaded image so the emojify service can fetch it
+		var err error
+		if uri, err = e.uploadImage(r, er.Image); err != nil {
+			st := http.StatusInternalServerError
+			if isDeadlineExceeded(err) {
+				st = http.StatusGatewayTimeout
+			} else if isCircuitOpen(err) {
+				st = http.StatusServiceUnavailable
+			}
 
-	// create a grpc context containing the parent span metadata
-	ctx := e.createContextFromRequest(r)
+			writeError(rw, r, st, "unable to store uploaded image", err)
+			done(st, err)
+			return
+		}
+	} else {
+		// validate the url
+		u, err := e.validateURL(r.Context(), []byte(er.URL))
+		if err != nil {
+			writeError(rw, r, http.StatusBadRequest, err.Error(), nil)
+			done(http.StatusBadRequest, err)
+			return
+		}
+
+		uri = u.String()
+	}
 
-	resp, err := e.emojify.Create(ctx, &wrappers.StringValue{Value: u.String()})
+	// the reserved key allows the call to the emojify service to be retried
+	resp, st, err := e.createJob(r, uri, er.Options, key)
+	e.setQuotaHeader(rw, r)
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		ecDone(http.StatusInternalServerError, err)
-		done(http.StatusInternalServerError, err)
+		writeError(rw, r, st, createJobErrorMessage(st), err)
+		done(st, err)
 		return
 	}
 
 	// return the image key
 	jr := EmojifyResponse{}.FromQueryItem(resp)
+	if key != "" {
+		e.keys.Store.Complete(key, jr)
+	}
+
 	rw.WriteHeader(http.StatusOK)
 	jr.WriteJSON(rw)
 	done(http.StatusOK, nil)
 }
 
-func (e *EmojifyPost) checkPostBody(r *http.Request) ([]byte, error) {
-	data, err := ioutil.ReadAll(r.Body)
+// reserveKey reserves the scoped idempotency key for the request, when the key
+// has already been used the stored response or an error is written and
+// replayed is true
+func (e *EmojifyPost) reserveKey(rw http.ResponseWriter, r *http.Request, scoped string, er *emojifyRequest) (int, bool) {
+	fp := requestFingerprint(er)
+
+	rec, ok := e.keys.Store.Reserve(scoped, fp)
+	if ok {
+		return 0, false
+	}
+
+	logger := e.logger.WithContext(r.Context())
+	key := r.Header.Get(IdempotencyKeyHeader)
+
+	if rec.Fingerprint != fp {
+		logger.EmojifyHandlerIdempotencyRejected(key, http.StatusUnprocessableEntity)
+		writeError(rw, r, http.StatusUnprocessableEntity, "idempotency key has been used with a different image", nil)
+		return http.StatusUnprocessableEntity, true
+	}
+
+	if !rec.Complete {
+		logger.EmojifyHandlerIdempotencyRejected(key, http.StatusConflict)
+		writeError(rw, r, http.StatusConflict, "a request with this idempotency key is in progress", nil)
+		return http.StatusConflict, true
+	}
+
+	logger.EmojifyHandlerIdempotentReplay(key)
+	rw.Header().Set("Idempotent-Replayed", "true")
+	rw.WriteHeader(http.StatusOK)
+	rec.Response.WriteJSON(rw)
+
+	return http.StatusOK, true
+}
+
+// createJob calls the emojify service to create a job for the uri, the
+// returned status is the HTTP status code for the result. Callers must check
+// the quota of the client with checkQuota, the quota is consumed once the job
+// has been created so concurrent requests may exceed the quota by the number
+// of jobs in flight. When key is set the call is made with an idempotency key
+// unique to the key and uri so it can be retried, key must have been reserved
+// in the IdempotencyStore.
+func (e *EmojifyPost) createJob(r *http.Request, uri string, options map[string]string, key string) (*emojify.QueryItem, int, error) {
+	subject := auth.SubjectFromContext(r.Context())
+
+	ecDone := e.logger.WithContext(r.Context()).EmojifyHandlerCallCreate(uri)
+
+	// create a grpc context containing the parent span metadata
+	ctx, cancel := e.createContextFromRequest(r, options, upstreamIdempotencyKey(key, uri))
+	defer cancel()
+
+	resp, err := e.emojify.Create(ctx, &wrappers.StringValue{Value: uri})
 	if err != nil {
-		e.logger.EmojifyHandlerNoPostBody()
+		st := http.StatusInternalServerError
+		if isDeadlineExceeded(err) {
+			st = http.StatusGatewayTimeout
+		} else if isCircuitOpen(err) {
+			st = http.StatusServiceUnavailable
+		}
+
+		ecDone(st, err)
+		return nil, st, err
+	}
+
+	ecDone(http.StatusOK, nil)
+
+	if e.jobs != nil {
+		e.jobs.Add(subject, Job{ID: resp.GetId(), Created: time.Now()})
+	}
+
+	if e.quota != nil && subject != "" {
+		if _, err := e.quota.Store.Consume(subject, time.Now()); err != nil {
+			e.logger.WithContext(r.Context()).EmojifyHandlerQuotaConsumeFailed(subject, err)
+		}
+	}
+
+	return resp, http.StatusOK, nil
+}
+
+// checkQuota returns errQuotaExceeded when the client making the request has
+// created all the jobs allowed by the quota
+func (e *EmojifyPost) checkQuota(r *http.Request) (int, error) {
+	subject := auth.SubjectFromContext(r.Context())
+	if e.quota == nil || subject == "" {
+		return http.StatusOK, nil
+	}
+
+	u, err := e.quota.Store.Usage(subject, time.Now())
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if e.quota.remaining(u) == 0 {
+		e.logger.WithContext(r.Context()).EmojifyHandlerQuotaExceeded(subject, e.quota.period(u))
+		return http.StatusTooManyRequests, errQuotaExceeded
+	}
+
+	return http.StatusOK, nil
+}
+
+// setQuotaHeader sets the X-Quota-Remaining header when the client has a
+// limited quota
+func (e *EmojifyPost) setQuotaHeader(rw http.ResponseWriter, r *http.Request) {
+	subject := auth.SubjectFromContext(r.Context())
+	if e.quota == nil || subject == "" {
+		return
+	}
+
+	u, err := e.quota.Store.Usage(subject, time.Now())
+	if err != nil {
+		return
+	}
+
+	if rem := e.quota.remaining(u); rem >= 0 {
+		rw.Header().Set(QuotaRemainingHeader, strconv.Itoa(rem))
+	}
+}
+
+// createJobErrorMessage returns the message for the client when createJob
+// fails with the given status
+func createJobErrorMessage(status int) string {
+	switch status {
+	case http.StatusGatewayTimeout:
+		return "timeout creating emojify job"
+	case http.StatusServiceUnavailable:
+		return "emojify service is unavailable"
+	case http.StatusTooManyRequests:
+		return "job quota exceeded"
+	}
+
+	return "unable to create emojify job"
+}
+
+func (e *EmojifyPost) checkPostBody(rw http.ResponseWriter, r *http.Request) (*emojifyRequest, *requestError) {
+	er, err := parseEmojifyRequest(rw, r, e.uploads.MaxSize)
+	if err != nil {
+		e.logger.WithContext(r.Context()).EmojifyHandlerInvalidBody(r.Header.Get("Content-Type"), err)
 		return nil, err
 	}
 
-	return data, nil
+	return er, nil
+}
+
+// uploadIDPrefix is the prefix of the cache id of uploaded images
+const uploadIDPrefix = "upload-"
+
+// uploadImage stores the image in the cache and returns the URL where the
+// emojify service can fetch it, images are keyed by the hash of their content
+// so repeated uploads of the same image are stored once
+func (e *EmojifyPost) uploadImage(r *http.Request, data []byte) (string, error) {
+	id := fmt.Sprintf("%s%x", uploadIDPrefix, sha256.Sum256(data))
+	uDone := e.logger.WithContext(r.Context()).EmojifyHandlerUploadImage(id, len(data))
+
+	ctx, cancel := upstreamContext(r, e.uploads.Timeout)
+	defer cancel()
+
+	_, err := e.uploads.Cache.Put(ctx, &cache.CacheItem{Id: id, Data: data})
+	if err != nil {
+		uDone(http.StatusInternalServerError, err)
+		return "", err
+	}
+
+	uDone(http.StatusOK, nil)
+	return e.uploads.BaseURL + "uploads/" + id, nil
 }
 
-func (e *EmojifyPost) createContextFromRequest(r *http.Request) context.Context {
-	var (
-		otHeaders = []string{
-			"x-request-id",
-			"x-b3-traceid",
-			"x-b3-spanid",
-			"x-b3-parentspanid",
-			"x-b3-sampled",
-			"x-b3-flags",
-			"x-ot-span-context"}
-	)
+// createContextFromRequest creates a grpc context for the request, the request
+// id and trace context are added to the metadata by the client interceptors.
+// Any options sent with the request are added to the metadata with the prefix
+// emojify-option-, a non empty key is added as the idempotency key so the call
+// can be retried.
+func (e *EmojifyPost) createContextFromRequest(r *http.Request, options map[string]string, key string) (context.Context, context.CancelFunc) {
 	var pairs []string
 
-	for _, h := range otHeaders {
-		if v := r.Header.Get(h); len(v) > 0 {
-			pairs = append(pairs, h, v)
-		}
+	if key != "" {
+		pairs = append(pairs, retry.IdempotencyKey, key)
 	}
 
-	e.logger.Log().Debug("received headers", "pairs", pairs)
+	for k, v := range options {
+		pairs = append(pairs, "emojify-option-"+strings.ToLower(k), v)
+	}
+
+	e.logger.WithContext(r.Context()).Log().Debug("emojify options", "pairs", pairs)
+
+	ctx, cancel := upstreamContext(r, e.timeout)
 
 	md := metadata.Pairs(pairs...)
-	return metadata.NewOutgoingContext(context.Background(), md)
+	return metadata.NewOutgoingContext(ctx, md), cancel
+}
+
+// upstreamIdempotencyKey returns the idempotency key for creating a job for
+// the uri with the client's key, an empty key returns an empty string
+func upstreamIdempotencyKey(key, uri string) string {
+	if key == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key+"\x00"+uri)))
 }
 
-func (e *EmojifyPost) validateURL(data []byte) (*url.URL, error) {
+func (e *EmojifyPost) validateURL(ctx context.Context, data []byte) (*url.URL, error) {
 	valid := govalidator.IsRequestURL(string(data))
 	if valid == false {
 		return nil, fmt.Errorf("%v is not a valid URL", string(data))
@@ -140,10 +400,23 @@ func (e *EmojifyPost) validateURL(data []byte) (*url.URL, error) {
 
 	u, err := url.ParseRequestURI(string(data))
 	if err != nil {
-		e.logger.EmojifyHandlerInvalidURL(string(data), err)
+		e.logger.WithContext(ctx).EmojifyHandlerInvalidURL(string(data), err)
 		return nil, fmt.Errorf("unable to parse %v", string(data))
 	}
 
+	if err := e.policy.Check(ctx, u); err != nil {
+		// the detail is logged but not returned to the client as it can
+		// contain internal addresses
+		logErr := err
+		var rerr *URLRejectedError
+		if errors.As(err, &rerr) && rerr.Detail != "" {
+			logErr = fmt.Errorf("%s: %s", err, rerr.Detail)
+		}
+
+		e.logger.WithContext(ctx).EmojifyHandlerURLRejected(u.String(), logErr)
+		return nil, err
+	}
+
 	return u, nil
 }
 
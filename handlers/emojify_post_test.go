@@ -2,22 +2,35 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/emojify-app/api/auth"
 	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/cache/protos/cache"
 	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 )
 
 var mockEmojifyer emojify.ClientMock
+var mockUploadCache cache.ClientMock
+var pngData = []byte("\x89PNG\r\n\x1a\n0000IHDR")
 
 func resetEmojifyMock() {
 	mockEmojifyer.ExpectedCalls = make([]*mock.Call, 0)
@@ -41,28 +54,54 @@ func setupEmojiPostHandler() (*httptest.ResponseRecorder, *http.Request, *Emojif
 		nil,
 	)
 
-	logger, _ := logging.New("test", "test", "localhost:8125", "error", "text")
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
 
 	rw := httptest.NewRecorder()
 	r := httptest.NewRequest("POST", "/", nil)
 
-	h := NewEmojifyPost(logger, &mockEmojifyer)
+	mockUploadCache = cache.ClientMock{}
+	mockUploadCache.On("Put", mock.Anything, mock.Anything, mock.Anything).Return(&wrappers.StringValue{}, nil)
+
+	h := NewEmojifyPost(logger, &mockEmojifyer, 0, ImageUploads{
+		Cache:   &mockUploadCache,
+		BaseURL: "http://localhost:9090",
+		MaxSize: 1024,
+	}, testURLPolicy(), Idempotency{Store: NewMemoryIdempotencyStore(time.Hour, 0)}, nil, nil)
 
 	return rw, r, h
 }
 
+// testURLPolicy returns the default URLPolicy with a resolver which does not
+// use the network, *.internal hosts resolve to a private address
+func testURLPolicy() *URLPolicy {
+	p := DefaultURLPolicy()
+	p.LookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if strings.HasSuffix(host, ".internal") {
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+		}
+
+		return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+	}
+
+	return p
+}
+
 func TestReturnsBadRequestIfBodyLessThan8(t *testing.T) {
 	rw, r, h := setupEmojiPostHandler()
 
 	h.ServeHTTP(rw, r)
 
+	er := ErrorResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &er)
+
 	assert.Equal(t, http.StatusBadRequest, rw.Code)
-	assert.Equal(t, " is not a valid URL\n", string(rw.Body.Bytes()))
+	assert.Equal(t, " is not a valid URL", er.Message)
 }
 
 func TestReturnsInvalidURLIfBodyNotURL(t *testing.T) {
 	rw, r, h := setupEmojiPostHandler()
 	r.Body = ioutil.NopCloser(bytes.NewBuffer([]byte("httsddfdfdf/cc")))
+	r.Header.Set("Accept", "text/plain")
 
 	h.ServeHTTP(rw, r)
 
@@ -103,5 +142,357 @@ func TestCallsEmojifyAndNotOK(t *testing.T) {
 	r.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(u.String())))
 	h.ServeHTTP(rw, r)
 
+	er := ErrorResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &er)
+
 	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	assert.Equal(t, "Internal", er.Upstream.Code)
+}
+
+func TestCallsEmojifyAndTimesOut(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+	resetEmojifyMock()
+
+	mockEmojifyer.On(
+		"Create",
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+	).Return(
+		nil,
+		grpc.Errorf(codes.DeadlineExceeded, "timeout"),
+	)
+
+	u, _ := url.Parse(fileURL)
+	r.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(u.String())))
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+}
+
+func TestCallsEmojifyWithJSONURL(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+	r.Header.Set("Content-Type", "application/json")
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(`{"url":"` + fileURL + `","options":{"Emoji":"grin"}}`))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	mockEmojifyer.AssertCalled(
+		t,
+		"Create",
+		mock.MatchedBy(func(ctx context.Context) bool {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			return len(md.Get("emojify-option-emoji")) == 1 && md.Get("emojify-option-emoji")[0] == "grin"
+		}),
+		&wrappers.StringValue{Value: fileURL},
+		mock.Anything,
+	)
+}
+
+// forwardedIdempotencyKey matches a context whose metadata contains the
+// idempotency key, an empty key matches a context without one
+func forwardedIdempotencyKey(key string) interface{} {
+	return mock.MatchedBy(func(ctx context.Context) bool {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		if key == "" {
+			return len(md.Get("idempotency-key")) == 0
+		}
+
+		return len(md.Get("idempotency-key")) == 1 && md.Get("idempotency-key")[0] == key
+	})
+}
+
+func TestForwardsIdempotencyKeyToEmojify(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+	r.Header.Set(IdempotencyKeyHeader, "key123")
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(fileURL))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	key := scopedIdempotencyKey(r, "key123", nil)
+	mockEmojifyer.AssertCalled(t, "Create", forwardedIdempotencyKey(upstreamIdempotencyKey(key, fileURL)), mock.Anything, mock.Anything)
+}
+
+func TestDoesNotForwardIdempotencyKeyWhenNotReserved(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+	h.keys.Store = nil
+	r.Header.Set(IdempotencyKeyHeader, "key123")
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(fileURL))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	mockEmojifyer.AssertCalled(t, "Create", forwardedIdempotencyKey(""), mock.Anything, mock.Anything)
+}
+
+func TestUpstreamIdempotencyKeyIsUniquePerURL(t *testing.T) {
+	assert.NotEqual(t, upstreamIdempotencyKey("key123", "http://a.com/a.png"), upstreamIdempotencyKey("key123", "http://a.com/b.png"))
+	assert.Equal(t, "", upstreamIdempotencyKey("", "http://a.com/a.png"))
+}
+
+func TestReturnsBadRequestWhenInvalidJSON(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+	r.Header.Set("Content-Type", "application/json")
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(`{"url":`))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestReturnsBadRequestWhenOptionsInvalid(t *testing.T) {
+	many := map[string]string{}
+	for i := 0; i <= maxOptions; i++ {
+		many[fmt.Sprintf("key%d", i)] = "v"
+	}
+
+	cases := []struct {
+		name    string
+		options map[string]string
+		field   string
+	}{
+		{"invalid key", map[string]string{"emoji key": "grin"}, "options"},
+		{"empty key", map[string]string{"": "grin"}, "options"},
+		{"long key", map[string]string{strings.Repeat("a", maxOptionKeyLength+1): "grin"}, "options"},
+		{"control character in value", map[string]string{"emoji": "grin\r\nx-injected: 1"}, "options.emoji"},
+		{"non ASCII value", map[string]string{"emoji": "grin😀"}, "options.emoji"},
+		{"long value", map[string]string{"emoji": strings.Repeat("a", maxOptionValueLength+1)}, "options.emoji"},
+		{"too many options", many, "options"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rw, r, h := setupEmojiPostHandler()
+			body, _ := json.Marshal(map[string]interface{}{"url": fileURL, "options": tc.options})
+			r.Header.Set("Content-Type", "application/json")
+			r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+
+			h.ServeHTTP(rw, r)
+
+			er := ErrorResponse{}
+			json.Unmarshal(rw.Body.Bytes(), &er)
+
+			assert.Equal(t, http.StatusBadRequest, rw.Code)
+			assert.Contains(t, er.Details, tc.field)
+			mockEmojifyer.AssertNotCalled(t, "Create", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestUploadsRawImageToCacheAndCallsEmojify(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+	r.Header.Set("Content-Type", "image/png")
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(pngData))
+
+	h.ServeHTTP(rw, r)
+
+	id := fmt.Sprintf("upload-%x", sha256.Sum256(pngData))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	mockUploadCache.AssertCalled(t, "Put", mock.Anything, &cache.CacheItem{Id: id, Data: pngData}, mock.Anything)
+	mockEmojifyer.AssertCalled(t, "Create", mock.Anything, &wrappers.StringValue{Value: "http://localhost:9090/uploads/" + id}, mock.Anything)
+}
+
+func TestUploadsMultipartImageToCacheAndCallsEmojify(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("image", "a.png")
+	fw.Write(pngData)
+	mw.Close()
+
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Body = ioutil.NopCloser(body)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	mockUploadCache.AssertNumberOfCalls(t, "Put", 1)
+}
+
+func TestReturnsUnsupportedMediaTypeWhenUploadNotImage(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+	r.Header.Set("Content-Type", "image/png")
+	r.Body = ioutil.NopCloser(bytes.NewBufferString("not an image"))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, rw.Code)
+	mockUploadCache.AssertNotCalled(t, "Put", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestReturnsRequestEntityTooLargeWhenUploadTooBig(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+	r.Header.Set("Content-Type", "image/png")
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(append(pngData, make([]byte, 2048)...)))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+}
+
+func TestReturnsBadRequestWhenURLRejectedByPolicy(t *testing.T) {
+	rw, r, h := setupEmojiPostHandler()
+	r.Body = ioutil.NopCloser(bytes.NewBufferString("http://169.254.169.254/latest/meta-data/"))
+
+	sink := logging.NewInMemorySink()
+	h.logger = logging.New("test", sink, "error", "text")
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, 1, sink.Count("service.api.emojify.url_rejected"))
+	mockEmojifyer.AssertNotCalled(t, "Create", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func postWithKey(h *EmojifyPost, key, body string) *httptest.ResponseRecorder {
+	return postWithKeyAs(h, "", key, body)
+}
+
+func postWithKeyAs(h *EmojifyPost, subject, key, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+	r.Header.Set(IdempotencyKeyHeader, key)
+	if subject != "" {
+		r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: subject}))
+	}
+
+	h.ServeHTTP(rw, r)
+
+	return rw
+}
+
+func TestReplaysResponseForRepeatedIdempotencyKey(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+
+	first := postWithKey(h, "key1", fileURL)
+	second := postWithKey(h, "key1", fileURL)
+
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	mockEmojifyer.AssertNumberOfCalls(t, "Create", 1)
+}
+
+func TestReturns422WhenIdempotencyKeyReusedWithDifferentURL(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+
+	postWithKey(h, "key1", fileURL)
+	rw := postWithKey(h, "key1", "http://something.com/b.jpg")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rw.Code)
+	mockEmojifyer.AssertNumberOfCalls(t, "Create", 1)
+}
+
+func TestReturns409WhenIdempotencyKeyInProgress(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+	h.keys.Store.Reserve(scopedIdempotencyKey(httptest.NewRequest("POST", "/", nil), "key1", nil), requestFingerprint(&emojifyRequest{URL: fileURL}))
+
+	rw := postWithKey(h, "key1", fileURL)
+
+	assert.Equal(t, http.StatusConflict, rw.Code)
+	mockEmojifyer.AssertNotCalled(t, "Create", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestIdempotencyKeysAreScopedToTheClient(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+
+	postWithKeyAs(h, "nic", "key1", fileURL)
+	other := postWithKeyAs(h, "erik", "key1", "http://something.com/b.jpg")
+	replay := postWithKeyAs(h, "erik", "key1", "http://something.com/b.jpg")
+
+	assert.Equal(t, http.StatusOK, other.Code)
+	assert.Empty(t, other.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "true", replay.Header().Get("Idempotent-Replayed"))
+	mockEmojifyer.AssertNumberOfCalls(t, "Create", 2)
+}
+
+func TestIdempotencyKeysAreScopedToTheForwardedClientIP(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+	_, proxies, _ := net.ParseCIDR("192.0.2.0/24")
+	h.keys.TrustedProxies = []*net.IPNet{proxies}
+
+	post := func(forwarded, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		r.Header.Set(IdempotencyKeyHeader, "key1")
+		r.Header.Set("X-Forwarded-For", forwarded)
+
+		h.ServeHTTP(rw, r)
+		return rw
+	}
+
+	post("203.0.113.1", fileURL)
+	other := post("203.0.113.2", "http://something.com/b.jpg")
+
+	assert.Equal(t, http.StatusOK, other.Code)
+	assert.Empty(t, other.Header().Get("Idempotent-Replayed"))
+	mockEmojifyer.AssertNumberOfCalls(t, "Create", 2)
+}
+
+func TestReleasesIdempotencyKeyWhenCreateFails(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+	resetEmojifyMock()
+	mockEmojifyer.On("Create", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("boom")).Once()
+	mockEmojifyer.On("Create", mock.Anything, mock.Anything, mock.Anything).Return(&emojify.QueryItem{Id: "abc"}, nil)
+
+	first := postWithKey(h, "key1", fileURL)
+	second := postWithKey(h, "key1", fileURL)
+
+	assert.Equal(t, http.StatusInternalServerError, first.Code)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Empty(t, second.Header().Get("Idempotent-Replayed"))
+}
+
+func TestMemoryIdempotencyStoreExpiresRecords(t *testing.T) {
+	s := NewMemoryIdempotencyStore(time.Minute, 0)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	_, ok := s.Reserve("key1", "a")
+	assert.True(t, ok)
+	s.Complete("key1", EmojifyResponse{ID: "abc"})
+
+	rec, ok := s.Reserve("key1", "a")
+	assert.False(t, ok)
+	assert.Equal(t, "abc", rec.Response.ID)
+
+	now = now.Add(2 * time.Minute)
+	_, ok = s.Reserve("key1", "a")
+	assert.True(t, ok)
+}
+
+func TestMemoryIdempotencyStoreRemovesExpiredRecords(t *testing.T) {
+	s := NewMemoryIdempotencyStore(time.Minute, 0)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	s.Reserve("key1", "a")
+	now = now.Add(30 * time.Second)
+	s.Reserve("key2", "a")
+
+	now = now.Add(45 * time.Second)
+	s.Reserve("key3", "a")
+
+	assert.Len(t, s.records, 2)
+	assert.NotContains(t, s.records, "key1")
+}
+
+func TestMemoryIdempotencyStoreRemovesOldestRecordWhenFull(t *testing.T) {
+	s := NewMemoryIdempotencyStore(time.Minute, 2)
+
+	s.Reserve("key1", "a")
+	s.Reserve("key2", "a")
+	s.Release("key2")
+	s.Reserve("key3", "a")
+	s.Reserve("key4", "a")
+
+	assert.Len(t, s.records, 2)
+	assert.NotContains(t, s.records, "key1")
+
+	_, ok := s.Reserve("key3", "a")
+	assert.False(t, ok)
 }
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// uploadFormField is the multipart form field containing an uploaded image
+const uploadFormField = "image"
+
+// allowedImageTypes are the content types which can be uploaded, the type is
+// detected from the uploaded bytes rather than trusted from the client
+var allowedImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+}
+
+// limits for the options of a request, options are forwarded to the emojify
+// service as gRPC metadata
+const (
+	maxOptions           = 16
+	maxOptionKeyLength   = 64
+	maxOptionValueLength = 256
+)
+
+// emojifyRequest is the parsed body of a request to POST /emojify, either URL
+// or Image is set
+type emojifyRequest struct {
+	URL     string            `json:"url"`
+	Options map[string]string `json:"options"`
+	Image   []byte            `json:"-"`
+}
+
+// requestError is returned when the body of a request can not be parsed,
+// Code is the HTTP status to return to the client and Details contains the
+// invalid fields
+type requestError struct {
+	Code    int
+	Err     error
+	Details map[string]string
+}
+
+func (r *requestError) Error() string {
+	return r.Err.Error()
+}
+
+func newRequestError(code int, format string, a ...interface{}) *requestError {
+	return &requestError{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// parseEmojifyRequest reads the body of the request dispatching on the
+// Content-Type, bodies larger than maxSize are rejected.
+//
+// application/json      {"url": "...", "options": {...}}
+// multipart/form-data   image file in the form field "image"
+// image/png, image/jpeg raw image bytes
+// anything else         the body is treated as a URL
+func parseEmojifyRequest(rw http.ResponseWriter, r *http.Request, maxSize int64) (*emojifyRequest, *requestError) {
+	if r.Body == nil {
+		return &emojifyRequest{}, nil
+	}
+
+	r.Body = http.MaxBytesReader(rw, r.Body, maxSize)
+
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch {
+	case mt == "application/json":
+		er := &emojifyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(er); err != nil {
+			return nil, bodyError(err, "invalid JSON payload")
+		}
+
+		if rerr := validateOptions(er.Options); rerr != nil {
+			return nil, rerr
+		}
+
+		return er, nil
+
+	case mt == "multipart/form-data":
+		if err := r.ParseMultipartForm(maxSize); err != nil {
+			return nil, bodyError(err, "invalid multipart form")
+		}
+
+		f, _, err := r.FormFile(uploadFormField)
+		if err != nil {
+			return nil, newRequestError(http.StatusBadRequest, "multipart form must contain the field %s", uploadFormField)
+		}
+		defer f.Close()
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, bodyError(err, "unable to read uploaded image")
+		}
+
+		return imageRequest(data)
+
+	case strings.HasPrefix(mt, "image/"):
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, bodyError(err, "unable to read uploaded image")
+		}
+
+		return imageRequest(data)
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, bodyError(err, "unable to read request body")
+	}
+
+	return &emojifyRequest{URL: string(data)}, nil
+}
+
+// imageRequest validates uploaded image data
+func imageRequest(data []byte) (*emojifyRequest, *requestError) {
+	if len(data) == 0 {
+		return nil, newRequestError(http.StatusBadRequest, "uploaded image is empty")
+	}
+
+	if ct := http.DetectContentType(data); !allowedImageTypes[ct] {
+		return nil, newRequestError(http.StatusUnsupportedMediaType, "unsupported image type %s", ct)
+	}
+
+	return &emojifyRequest{Image: data}, nil
+}
+
+// validateOptions checks the options can be sent as gRPC metadata, keys may
+// only contain a-z, 0-9, -, _ and . after they are lowercased and values only
+// printable ASCII characters
+func validateOptions(options map[string]string) *requestError {
+	if len(options) > maxOptions {
+		rerr := newRequestError(http.StatusBadRequest, "invalid options")
+		rerr.Details = map[string]string{"options": fmt.Sprintf("must contain at most %d options", maxOptions)}
+		return rerr
+	}
+
+	details := map[string]string{}
+	for k, v := range options {
+		if !validOptionKey(strings.ToLower(k)) {
+			details["options"] = fmt.Sprintf("keys must be 1 to %d characters a-z, 0-9, -, _ or .", maxOptionKeyLength)
+			continue
+		}
+
+		if !validOptionValue(v) {
+			details["options."+strings.ToLower(k)] = fmt.Sprintf("must be at most %d printable ASCII characters", maxOptionValueLength)
+		}
+	}
+
+	if len(details) > 0 {
+		rerr := newRequestError(http.StatusBadRequest, "invalid options")
+		rerr.Details = details
+		return rerr
+	}
+
+	return nil
+}
+
+func validOptionKey(k string) bool {
+	if len(k) == 0 || len(k) > maxOptionKeyLength {
+		return false
+	}
+
+	for _, c := range k {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func validOptionValue(v string) bool {
+	if len(v) > maxOptionValueLength {
+		return false
+	}
+
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bodyError converts an error reading the request body into a requestError
+func bodyError(err error, message string) *requestError {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return newRequestError(http.StatusRequestEntityTooLarge, "request body too large")
+	}
+
+	return newRequestError(http.StatusBadRequest, "%s: %s", message, err)
+}
@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/gorilla/websocket"
+)
+
+// maxWebSocketMessageSize is the maximum size in bytes of a message from the
+// client, larger messages close the connection with 1009
+const maxWebSocketMessageSize = 4096
+
+// WebSocketConfig configures connections to the EmojifyWebSocket handler
+type WebSocketConfig struct {
+	// MaxJobs is the maximum number of unfinished jobs a connection can track
+	MaxJobs int
+	// PollInterval is the delay between queries for the status of tracked jobs
+	PollInterval time.Duration
+	// PingInterval is the delay between heartbeat pings sent to the client
+	PingInterval time.Duration
+	// PongTimeout is the maximum time to wait for a message or pong from the
+	// client before the connection is closed, must be greater than
+	// PingInterval
+	PongTimeout time.Duration
+	// AllowedOrigin is the origin permitted to open connections, * allows any
+	// origin
+	AllowedOrigin string
+}
+
+// WebSocketMessage is the JSON message sent between the client and the
+// EmojifyWebSocket handler.
+//
+// Clients send {"type": "create", "ref": "abc", "url": "http://..."} to
+// create a job, the server replies with a created or error message containing
+// the same ref and then sends a status message each time a job changes until
+// the job has finished.
+type WebSocketMessage struct {
+	Type  string           `json:"type"`
+	Ref   string           `json:"ref,omitempty"`
+	URL   string           `json:"url,omitempty"`
+	Job   *EmojifyResponse `json:"job,omitempty"`
+	Error *ErrorResponse   `json:"error,omitempty"`
+}
+
+// WebSocket message types
+const (
+	WebSocketCreate  = "create"
+	WebSocketCreated = "created"
+	WebSocketStatus  = "status"
+	WebSocketError   = "error"
+)
+
+// EmojifyWebSocket is a http.Handler which allows clients to create and track
+// multiple emojify jobs over a single WebSocket connection
+type EmojifyWebSocket struct {
+	logger   logging.Logger
+	post     *EmojifyPost
+	config   WebSocketConfig
+	upgrader websocket.Upgrader
+
+	// conns tracks open connections, http.Server does not track connections
+	// once they have been upgraded
+	conns sync.WaitGroup
+}
+
+// NewEmojifyWebSocket returns a new instance of the EmojifyWebSocket handler,
+// jobs are created using the upstream, timeout and URL policy of post
+func NewEmojifyWebSocket(l logging.Logger, post *EmojifyPost, config WebSocketConfig) *EmojifyWebSocket {
+	u := websocket.Upgrader{}
+	if config.AllowedOrigin == "*" {
+		u.CheckOrigin = func(r *http.Request) bool { return true }
+	} else if config.AllowedOrigin != "" {
+		u.CheckOrigin = func(r *http.Request) bool { return r.Header.Get("Origin") == config.AllowedOrigin }
+	}
+
+	return &EmojifyWebSocket{logger: l, post: post, config: config, upgrader: u}
+}
+
+// ServeHTTP implements the handler function
+func (e *EmojifyWebSocket) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	done := e.logger.WithContext(r.Context()).EmojifyHandlerWebSocketCalled(r)
+
+	// the connection is tracked before the upgrade so Wait can not return
+	// while the server is shutting down and the upgrade is in progress
+	e.conns.Add(1)
+	defer e.conns.Done()
+
+	// Upgrade writes an error response to the client on failure
+	conn, err := e.upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		done(http.StatusBadRequest, err)
+		return
+	}
+	defer conn.Close()
+
+	// the connection is closed with 1001 when the server begins shutting down
+	ctx, cancel := streamContext(r)
+	defer cancel()
+
+	c := &wsConnection{
+		handler: e,
+		conn:    conn,
+		r:       r,
+		send:    make(chan *WebSocketMessage, 16),
+		jobs:    map[string]*EmojifyResponse{},
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); c.writeLoop(ctx, cancel) }()
+	go func() { defer wg.Done(); c.pollLoop(ctx) }()
+
+	err = c.readLoop(ctx)
+	shutdown := isShuttingDown(ctx)
+	cancel()
+	wg.Wait()
+
+	if !shutdown && websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		done(http.StatusSwitchingProtocols, err)
+		return
+	}
+
+	done(http.StatusSwitchingProtocols, nil)
+}
+
+// Wait blocks until every connection has closed or ctx is done, call it after
+// http.Server.Shutdown to wait for connections which are closing
+func (e *EmojifyWebSocket) Wait(ctx context.Context) error {
+	closed := make(chan struct{})
+	go func() {
+		e.conns.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wsConnection holds the state for a single WebSocket connection
+type wsConnection struct {
+	handler *EmojifyWebSocket
+	conn    *websocket.Conn
+	r       *http.Request
+	send    chan *WebSocketMessage
+
+	mutex sync.Mutex
+	jobs  map[string]*EmojifyResponse
+}
+
+// readLoop reads messages from the client until the connection is closed
+func (c *wsConnection) readLoop(ctx context.Context) error {
+	config := c.handler.config
+
+	c.conn.SetReadLimit(maxWebSocketMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(config.PongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(config.PongTimeout))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		// the connection is closing, wait for the client to reply to the
+		// close message without extending the deadline
+		if ctx.Err() != nil {
+			continue
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(config.PongTimeout))
+
+		m := &WebSocketMessage{}
+		if err := json.Unmarshal(data, m); err != nil {
+			c.sendError(ctx, "", http.StatusBadRequest, "invalid message", nil)
+			continue
+		}
+
+		switch m.Type {
+		case WebSocketCreate:
+			c.create(ctx, m)
+		default:
+			c.sendError(ctx, m.Ref, http.StatusBadRequest, fmt.Sprintf("unknown message type %s", m.Type), nil)
+		}
+	}
+}
+
+// create validates the URL and creates a new emojify job
+func (c *wsConnection) create(ctx context.Context, m *WebSocketMessage) {
+	post := c.handler.post
+
+	c.mutex.Lock()
+	active := len(c.jobs)
+	c.mutex.Unlock()
+
+	if active >= c.handler.config.MaxJobs {
+		c.sendError(ctx, m.Ref, http.StatusTooManyRequests, fmt.Sprintf("connection is limited to %d active jobs", c.handler.config.MaxJobs), nil)
+		return
+	}
+
+	// each job is charged to the rate limit of the client, the upgrade request
+	// only counts as one request
+	r := c.r.WithContext(ctx)
+	if !takeRateLimit(r) {
+		c.sendError(ctx, m.Ref, http.StatusTooManyRequests, "rate limit exceeded", nil)
+		return
+	}
+
+	if st, err := post.checkQuota(r); err != nil {
+		c.sendError(ctx, m.Ref, st, createJobErrorMessage(st), err)
+		return
+	}
+
+	u, err := post.validateURL(ctx, []byte(m.URL))
+	if err != nil {
+		c.sendError(ctx, m.Ref, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	qi, st, err := post.createJob(r, u.String(), nil, "")
+	if err != nil {
+		c.sendError(ctx, m.Ref, st, createJobErrorMessage(st), err)
+		return
+	}
+
+	job := EmojifyResponse{}.FromQueryItem(qi)
+	if job.Status != emojify.QueryStatus_FINISHED.String() {
+		c.mutex.Lock()
+		c.jobs[job.ID] = &job
+		c.mutex.Unlock()
+	}
+
+	c.sendMessage(ctx, &WebSocketMessage{Type: WebSocketCreated, Ref: m.Ref, Job: &job})
+}
+
+// pollLoop queries the status of all tracked jobs, a status message is sent
+// each time a job changes and finished jobs are no longer tracked
+func (c *wsConnection) pollLoop(ctx context.Context) {
+	post := c.handler.post
+
+	t := time.NewTicker(c.handler.config.PollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		c.mutex.Lock()
+		ids := make([]string, 0, len(c.jobs))
+		for id := range c.jobs {
+			ids = append(ids, id)
+		}
+		c.mutex.Unlock()
+
+		for _, id := range ids {
+			qDone := c.handler.logger.WithContext(ctx).EmojifyHandlerCallQuery(id)
+
+			qctx, cancel := upstreamContext(c.r.WithContext(ctx), post.timeout)
+			qi, err := post.emojify.Query(qctx, &wrappers.StringValue{Value: id})
+			cancel()
+
+			// errors are retried on the next poll
+			if err != nil {
+				qDone(http.StatusInternalServerError, err)
+				continue
+			}
+
+			qDone(http.StatusOK, nil)
+
+			job := EmojifyResponse{}.FromQueryItem(qi)
+
+			c.mutex.Lock()
+			last := c.jobs[id]
+			if job.Status == emojify.QueryStatus_FINISHED.String() {
+				delete(c.jobs, id)
+			} else {
+				c.jobs[id] = &job
+			}
+			c.mutex.Unlock()
+
+			if last == nil || *last != job {
+				c.sendMessage(ctx, &WebSocketMessage{Type: WebSocketStatus, Job: &job})
+			}
+		}
+	}
+}
+
+// writeLoop writes queued messages and heartbeat pings to the client, all
+// writes to the connection happen here as the connection supports a single
+// writer
+func (c *wsConnection) writeLoop(ctx context.Context, cancel context.CancelFunc) {
+	config := c.handler.config
+
+	t := time.NewTicker(config.PingInterval)
+	defer t.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-ctx.Done():
+			code, text := websocket.CloseNormalClosure, ""
+			if isShuttingDown(ctx) {
+				code, text = websocket.CloseGoingAway, "server is shutting down"
+			}
+
+			c.conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(code, text),
+				time.Now().Add(time.Second),
+			)
+
+			// when shutting down the read loop is still running, it ends when
+			// the client replies to the close message or after the deadline
+			if code == websocket.CloseGoingAway {
+				c.conn.SetReadDeadline(time.Now().Add(time.Second))
+			}
+			return
+
+		case m := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(config.PongTimeout))
+			err = c.conn.WriteJSON(m)
+
+		case <-t.C:
+			err = c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(config.PongTimeout))
+		}
+
+		if err != nil {
+			// closing the connection unblocks the read loop
+			cancel()
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// sendMessage queues a message for the write loop, returns false if the
+// connection has closed
+func (c *wsConnection) sendMessage(ctx context.Context, m *WebSocketMessage) bool {
+	select {
+	case c.send <- m:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *wsConnection) sendError(ctx context.Context, ref string, code int, message string, err error) bool {
+	return c.sendMessage(ctx, &WebSocketMessage{
+		Type:  WebSocketError,
+		Ref:   ref,
+		Error: newErrorResponse(c.r, code, message, err),
+	})
+}
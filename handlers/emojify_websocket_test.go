@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func setupEmojifyWebSocket(t *testing.T, maxJobs int) (*websocket.Conn, *emojify.ClientMock, func()) {
+	conn, ec, _, cleanup := setupWebSocketServer(t, maxJobs, nil, context.Background())
+	return conn, ec, cleanup
+}
+
+func setupRateLimitedWebSocket(t *testing.T, maxJobs int, rl *RateLimiter) (*websocket.Conn, *emojify.ClientMock, func()) {
+	conn, ec, _, cleanup := setupWebSocketServer(t, maxJobs, rl, context.Background())
+	return conn, ec, cleanup
+}
+
+// setupWebSocketServer creates a connection to the handler, requests are
+// limited by rl when it is not nil and streams end when shutdown is cancelled
+func setupWebSocketServer(t *testing.T, maxJobs int, rl *RateLimiter, shutdown context.Context) (*websocket.Conn, *emojify.ClientMock, *EmojifyWebSocket, func()) {
+	ec := &emojify.ClientMock{}
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	post := NewEmojifyPost(logger, ec, 0, ImageUploads{}, testURLPolicy(), Idempotency{}, nil, nil)
+	h := NewEmojifyWebSocket(logger, post, WebSocketConfig{
+		MaxJobs:      maxJobs,
+		PollInterval: 5 * time.Millisecond,
+		PingInterval: time.Second,
+		PongTimeout:  2 * time.Second,
+	})
+
+	var handler http.Handler = h
+	if rl != nil {
+		handler = rl.Middleware(h)
+	}
+
+	s := httptest.NewUnstartedServer(handler)
+	s.Config.BaseContext = func(net.Listener) context.Context {
+		return WithShutdown(context.Background(), shutdown)
+	}
+	s.Start()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, ec, h, func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+func readWebSocketMessage(t *testing.T, conn *websocket.Conn) *WebSocketMessage {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	m := &WebSocketMessage{}
+	if err := conn.ReadJSON(m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestWebSocketCreatesJobAndPushesStatusUntilFinished(t *testing.T) {
+	conn, ec, cleanup := setupEmojifyWebSocket(t, 5)
+	defer cleanup()
+
+	ec.On("Create", mock.Anything, &wrappers.StringValue{Value: fileURL}, mock.Anything).Return(queryItem(2, emojify.QueryStatus_QUEUED), nil)
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(1, emojify.QueryStatus_QUEUED), nil).Once()
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(0, emojify.QueryStatus_FINISHED), nil)
+
+	conn.WriteJSON(&WebSocketMessage{Type: WebSocketCreate, Ref: "1", URL: fileURL})
+
+	m := readWebSocketMessage(t, conn)
+	assert.Equal(t, WebSocketCreated, m.Type)
+	assert.Equal(t, "1", m.Ref)
+	assert.Equal(t, int32(2), m.Job.Position)
+
+	m = readWebSocketMessage(t, conn)
+	assert.Equal(t, WebSocketStatus, m.Type)
+	assert.Equal(t, int32(1), m.Job.Position)
+
+	m = readWebSocketMessage(t, conn)
+	assert.Equal(t, WebSocketStatus, m.Type)
+	assert.Equal(t, "FINISHED", m.Job.Status)
+}
+
+func TestWebSocketReturnsErrorWhenJobLimitReached(t *testing.T) {
+	conn, ec, cleanup := setupEmojifyWebSocket(t, 1)
+	defer cleanup()
+
+	ec.On("Create", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(2, emojify.QueryStatus_QUEUED), nil)
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(2, emojify.QueryStatus_QUEUED), nil)
+
+	conn.WriteJSON(&WebSocketMessage{Type: WebSocketCreate, Ref: "1", URL: fileURL})
+	conn.WriteJSON(&WebSocketMessage{Type: WebSocketCreate, Ref: "2", URL: fileURL + "?b"})
+
+	assert.Equal(t, WebSocketCreated, readWebSocketMessage(t, conn).Type)
+
+	m := readWebSocketMessage(t, conn)
+	assert.Equal(t, WebSocketError, m.Type)
+	assert.Equal(t, "2", m.Ref)
+	assert.Equal(t, 429, m.Error.Code)
+}
+
+func TestWebSocketReturnsErrorForInvalidURL(t *testing.T) {
+	conn, ec, cleanup := setupEmojifyWebSocket(t, 1)
+	defer cleanup()
+
+	conn.WriteJSON(&WebSocketMessage{Type: WebSocketCreate, Ref: "1", URL: "http://127.0.0.1/a.png"})
+
+	m := readWebSocketMessage(t, conn)
+	assert.Equal(t, WebSocketError, m.Type)
+	assert.Equal(t, 400, m.Error.Code)
+	ec.AssertNotCalled(t, "Create", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestWebSocketClosesConnectionWhenMessageTooBig(t *testing.T) {
+	conn, _, cleanup := setupEmojifyWebSocket(t, 1)
+	defer cleanup()
+
+	conn.WriteMessage(websocket.TextMessage, make([]byte, maxWebSocketMessageSize+1))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+}
+
+func TestWebSocketChargesRateLimitForEachJob(t *testing.T) {
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+	rl, _ := NewRateLimiter(logger, "emojify", RateLimit{Rate: 0.001, Burst: 2, Key: RateLimitKeyIP})
+
+	conn, ec, cleanup := setupRateLimitedWebSocket(t, 5, rl)
+	defer cleanup()
+
+	ec.On("Create", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(2, emojify.QueryStatus_QUEUED), nil)
+	ec.On("Query", mock.Anything, mock.Anything, mock.Anything).Return(queryItem(2, emojify.QueryStatus_QUEUED), nil)
+
+	// the upgrade request takes the first token
+	conn.WriteJSON(&WebSocketMessage{Type: WebSocketCreate, Ref: "1", URL: fileURL})
+	conn.WriteJSON(&WebSocketMessage{Type: WebSocketCreate, Ref: "2", URL: fileURL + "?b"})
+
+	assert.Equal(t, WebSocketCreated, readWebSocketMessage(t, conn).Type)
+
+	m := readWebSocketMessage(t, conn)
+	assert.Equal(t, WebSocketError, m.Type)
+	assert.Equal(t, "2", m.Ref)
+	assert.Equal(t, http.StatusTooManyRequests, m.Error.Code)
+	ec.AssertNumberOfCalls(t, "Create", 1)
+}
+
+func TestWebSocketClosesConnectionWithGoingAwayWhenServerShuttingDown(t *testing.T) {
+	shutdown, cancel := context.WithCancel(context.Background())
+
+	conn, _, h, cleanup := setupWebSocketServer(t, 1, nil, shutdown)
+	defer cleanup()
+
+	cancel()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+
+	ctx, wcancel := context.WithTimeout(context.Background(), time.Second)
+	defer wcancel()
+	assert.NoError(t, h.Wait(ctx))
+}
@@ -39,12 +39,12 @@ func (j *ErrorMiddleware) Middleware(next http.Handler) http.Handler {
 
 		// calculate if we need to throw an error or continue as normal
 		if j.requestCount%j.errorPercentage == 0 {
-			j.logger.ErrorInjectionHandlerError(j.requestCount, j.errorPercentage, j.errorType)
+			j.logger.WithContext(r.Context()).ErrorInjectionHandlerError(j.requestCount, j.errorPercentage, j.errorType)
 
 			// is our error a delay or a timeout
 			if j.errorType == "http_error" {
 				// http error
-				http.Error(rw, "Error serving request", j.errorCode)
+				writeError(rw, r, j.errorCode, "Error serving request", nil)
 				return // do not call next
 			}
 
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emojify-app/api/requestid"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorResponse is the envelope written to the client by every handler when a
+// request fails
+type ErrorResponse struct {
+	// Code is the HTTP status code of the response
+	Code int `json:"code"`
+	// Message is a human readable description of the error
+	Message string `json:"message"`
+	// RequestID is the id of the request which caused the error
+	RequestID string `json:"request_id,omitempty"`
+	// Upstream is the gRPC status returned by an upstream service
+	Upstream *UpstreamStatus `json:"upstream,omitempty"`
+	// Details contains additional information such as invalid fields
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// UpstreamStatus is a JSON representation of a gRPC status
+type UpstreamStatus struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newErrorResponse creates an ErrorResponse for the request, when err contains
+// a gRPC status this is added to the response as the upstream status
+func newErrorResponse(r *http.Request, code int, message string, err error) *ErrorResponse {
+	er := &ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: requestID(r),
+	}
+
+	if s, ok := status.FromError(err); ok && err != nil {
+		er.Upstream = &UpstreamStatus{s.Code().String(), s.Message()}
+	}
+
+	return er
+}
+
+// writeError writes an ErrorResponse to the client, see newErrorResponse
+func writeError(rw http.ResponseWriter, r *http.Request, code int, message string, err error) {
+	newErrorResponse(r, code, message, err).Write(rw, r)
+}
+
+// Write writes the ErrorResponse to the client, the response is JSON unless
+// the client prefers text/plain
+func (er *ErrorResponse) Write(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if prefersPlainText(r) {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(er.Code)
+		fmt.Fprintln(rw, er.Message)
+
+		keys := make([]string, 0, len(er.Details))
+		for k := range er.Details {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Fprintf(rw, "%s: %s\n", k, er.Details[k])
+		}
+
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(er.Code)
+	json.NewEncoder(rw).Encode(er)
+}
+
+// requestID returns the id assigned to the request by the request id
+// middleware, falls back to the X-Request-Id header when the middleware is not
+// installed
+func requestID(r *http.Request) string {
+	if id := requestid.FromContext(r.Context()); id != "" {
+		return id
+	}
+
+	return r.Header.Get(requestid.Header)
+}
+
+// prefersPlainText returns true when the Accept header of the request ranks
+// text/plain higher than application/json
+func prefersPlainText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+
+	jsonQ, textQ := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+
+		switch mt {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/plain":
+			textQ = max(textQ, q)
+		}
+	}
+
+	return textQ > 0 && textQ > jsonQ
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emojify-app/api/requestid"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteErrorReturnsJSONEnvelope(t *testing.T) {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("x-request-id", "abc123")
+
+	writeError(rw, r, http.StatusNotFound, "not found", status.Error(codes.NotFound, "missing"))
+
+	er := ErrorResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &er)
+
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusNotFound, er.Code)
+	assert.Equal(t, "not found", er.Message)
+	assert.Equal(t, "abc123", er.RequestID)
+	assert.Equal(t, "NotFound", er.Upstream.Code)
+	assert.Equal(t, "missing", er.Upstream.Message)
+}
+
+func TestWriteErrorOmitsUpstreamForNonGRPCErrors(t *testing.T) {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+
+	writeError(rw, r, http.StatusBadRequest, "bad", fmt.Errorf("boom"))
+
+	er := ErrorResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &er)
+
+	assert.Nil(t, er.Upstream)
+}
+
+func TestWriteErrorReturnsTextWhenPreferred(t *testing.T) {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/json;q=0.5, text/plain")
+
+	writeError(rw, r, http.StatusBadRequest, "bad request", nil)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "bad request\n", rw.Body.String())
+}
+
+func TestWriteErrorReturnsJSONWhenPreferred(t *testing.T) {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/plain;q=0.5, application/json, */*")
+
+	writeError(rw, r, http.StatusBadRequest, "bad request", nil)
+
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+}
+
+func TestWriteErrorUsesRequestIDFromContext(t *testing.T) {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(requestid.NewContext(r.Context(), "ctx123"))
+	r.Header.Set("x-request-id", "header123")
+
+	writeError(rw, r, http.StatusNotFound, "not found", nil)
+
+	er := ErrorResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &er)
+
+	assert.Equal(t, "ctx123", er.RequestID)
+}
@@ -1,9 +1,10 @@
 package handlers
 
 import (
-	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/emojify-app/api/logging"
 	"github.com/emojify-app/cache/protos/cache"
@@ -13,48 +14,180 @@ import (
 
 // Health is a HTTP handler for serving health requests
 type Health struct {
-	logger logging.Logger
-	ec     emojify.EmojifyClient
-	cc     cache.CacheClient
+	logger         logging.Logger
+	ec             emojify.EmojifyClient
+	cc             cache.CacheClient
+	emojifyTimeout time.Duration
+	cacheTimeout   time.Duration
 }
 
-// NewHealth returns a new instance of the Health handler
-func NewHealth(l logging.Logger, ec emojify.EmojifyClient, cc cache.CacheClient) *Health {
-	return &Health{l, ec, cc}
+// NewHealth returns a new instance of the Health handler, the timeouts are the
+// maximum duration to wait for each upstream health check
+func NewHealth(l logging.Logger, ec emojify.EmojifyClient, cc cache.CacheClient, emojifyTimeout, cacheTimeout time.Duration) *Health {
+	return &Health{l, ec, cc, emojifyTimeout, cacheTimeout}
 }
 
 // ServeHTTP implements the http.Handler interface
 func (h *Health) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	done := h.logger.HealthHandlerCalled()
+	logger := h.logger.WithContext(r.Context())
+	done := logger.HealthHandlerCalled()
 	st := http.StatusOK
 
 	// check cache health
-	respC, errC := h.cc.Check(context.Background(), &cache.HealthCheckRequest{})
+	ctxC, cancelC := upstreamContext(r, h.cacheTimeout)
+	defer cancelC()
+	respC, errC := h.cc.Check(ctxC, &cache.HealthCheckRequest{})
+
 	// check emojify health
-	respE, errE := h.ec.Check(context.Background(), &emojify.HealthCheckRequest{})
+	ctxE, cancelE := upstreamContext(r, h.emojifyTimeout)
+	defer cancelE()
+	respE, errE := h.ec.Check(ctxE, &emojify.HealthCheckRequest{})
 
-	if errC != nil || errE != nil {
+	details := map[string]string{}
+	if errC != nil {
+		errString := fmt.Sprintf("Error checking cache health %s", status.Convert(errC).Message())
+
+		logger.Log().Error("Health handler error", "error", errString)
+		details["cache"] = errString
+	}
+
+	if errE != nil {
+		errString := fmt.Sprintf("Error checking emojify health %s", status.Convert(errE).Message())
+
+		logger.Log().Error("Health handler error", "error", errString)
+		details["emojify"] = errString
+	}
+
+	if len(details) > 0 {
 		st = http.StatusInternalServerError
-		rw.WriteHeader(http.StatusInternalServerError)
+		if isDeadlineExceeded(errC) || isDeadlineExceeded(errE) {
+			st = http.StatusGatewayTimeout
+		}
+
+		er := newErrorResponse(r, st, "upstream health check failed", nil)
+		er.Details = details
+		er.Write(rw, r)
+
+		done(st, nil)
+		return
 	}
 
-	if s := status.Convert(errC); errC != nil && s != nil {
-		errString := fmt.Sprintf("Error checking cache health %s", s.Message())
+	rw.Write([]byte(fmt.Sprintf("Cache status: %d\n", respC.GetStatus())))
+	rw.Write([]byte(fmt.Sprintf("Emojify status: %d\n", respE.GetStatus())))
+
+	done(st, nil)
+}
 
-		h.logger.Log().Error("Health handler error", "error", errString)
-		rw.Write([]byte(fmt.Sprintf("Cache status: %s\n", errString)))
-	} else {
-		rw.Write([]byte(fmt.Sprintf("Cache status: %d\n", respC.GetStatus())))
+// HealthLive is a HTTP handler for liveness checks, it only reports that the
+// process is able to serve requests and does not check any dependencies
+type HealthLive struct {
+	logger logging.Logger
+}
+
+// NewHealthLive returns a new instance of the HealthLive handler
+func NewHealthLive(l logging.Logger) *HealthLive {
+	return &HealthLive{l}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h *HealthLive) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	done := h.logger.WithContext(r.Context()).HealthHandlerCalled()
+
+	rw.Write([]byte("OK\n"))
+
+	done(http.StatusOK, nil)
+}
+
+// HealthReady is a HTTP handler for readiness checks, the service is ready
+// when every critical dependency was healthy at the last background check
+type HealthReady struct {
+	logger logging.Logger
+	prober *HealthProber
+}
+
+// NewHealthReady returns a new instance of the HealthReady handler
+func NewHealthReady(l logging.Logger, p *HealthProber) *HealthReady {
+	return &HealthReady{l, p}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h *HealthReady) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	done := h.logger.WithContext(r.Context()).HealthHandlerCalled()
+
+	statuses := h.prober.Statuses()
+	if dependenciesReady(statuses) {
+		rw.Write([]byte("OK\n"))
+		done(http.StatusOK, nil)
+		return
+	}
+
+	details := map[string]string{}
+	for _, s := range statuses {
+		if !s.Critical || s.Healthy {
+			continue
+		}
+
+		details[s.Name] = s.LastError
+		if s.LastChecked == nil {
+			details[s.Name] = "not checked"
+		}
 	}
 
-	if s := status.Convert(errE); errE != nil && s != nil {
-		errString := fmt.Sprintf("Error checking emojify health %s", s.Message())
+	er := newErrorResponse(r, http.StatusServiceUnavailable, "critical dependency is unhealthy", nil)
+	er.Details = details
+	er.Write(rw, r)
+
+	done(http.StatusServiceUnavailable, nil)
+}
+
+// Overall health reported by the HealthDetails handler
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+// HealthDetailsResponse is returned by the HealthDetails handler
+type HealthDetailsResponse struct {
+	// Status is ok when every dependency is healthy, degraded when only
+	// non-critical dependencies are unhealthy and unavailable otherwise
+	Status       string             `json:"status"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// HealthDetails is a HTTP handler which returns the status of every
+// dependency from the last background check
+type HealthDetails struct {
+	logger logging.Logger
+	prober *HealthProber
+}
+
+// NewHealthDetails returns a new instance of the HealthDetails handler
+func NewHealthDetails(l logging.Logger, p *HealthProber) *HealthDetails {
+	return &HealthDetails{l, p}
+}
+
+// ServeHTTP implements the http.Handler interface, the status code is 200
+// unless the service is unavailable when it is 503
+func (h *HealthDetails) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	done := h.logger.WithContext(r.Context()).HealthHandlerCalled()
+
+	resp := HealthDetailsResponse{Status: HealthOK, Dependencies: h.prober.Statuses()}
+	for _, s := range resp.Dependencies {
+		if !s.Healthy {
+			resp.Status = HealthDegraded
+		}
+	}
 
-		h.logger.Log().Error("Health handler error", "error", errString)
-		rw.Write([]byte(fmt.Sprintf("Emojify status: %s\n", errString)))
-	} else {
-		rw.Write([]byte(fmt.Sprintf("Emojify status: %d\n", respE.GetStatus())))
+	st := http.StatusOK
+	if !dependenciesReady(resp.Dependencies) {
+		resp.Status = HealthUnavailable
+		st = http.StatusServiceUnavailable
 	}
 
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(st)
+	json.NewEncoder(rw).Encode(resp)
+
 	done(st, nil)
 }
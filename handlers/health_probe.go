@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emojify-app/api/breaker"
+	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/cache/protos/cache"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"google.golang.org/grpc/status"
+)
+
+// Dependency is an upstream service which is checked by the HealthProber
+type Dependency struct {
+	Name string
+	// Critical dependencies must be healthy for the service to be ready
+	Critical bool
+	// Timeout is the maximum duration of a single check, 0 disables the
+	// timeout
+	Timeout time.Duration
+	// Check returns an error when the dependency is unhealthy
+	Check func(ctx context.Context) error
+	// Breaker is the circuit breaker for the dependency, the state is
+	// reported in the status when set
+	Breaker *breaker.Breaker
+}
+
+// CacheDependency returns a Dependency which calls the health check of the
+// cache service
+func CacheDependency(cc cache.CacheClient, timeout time.Duration, critical bool) Dependency {
+	return Dependency{
+		Name:     "cache",
+		Critical: critical,
+		Timeout:  timeout,
+		Check: func(ctx context.Context) error {
+			resp, err := cc.Check(ctx, &cache.HealthCheckRequest{})
+			if err != nil {
+				return err
+			}
+
+			if resp.GetStatus() != cache.HealthCheckResponse_SERVING {
+				return fmt.Errorf("cache status %s", resp.GetStatus())
+			}
+
+			return nil
+		},
+	}
+}
+
+// EmojifyDependency returns a Dependency which calls the health check of the
+// emojify service
+func EmojifyDependency(ec emojify.EmojifyClient, timeout time.Duration, critical bool) Dependency {
+	return Dependency{
+		Name:     "emojify",
+		Critical: critical,
+		Timeout:  timeout,
+		Check: func(ctx context.Context) error {
+			resp, err := ec.Check(ctx, &emojify.HealthCheckRequest{})
+			if err != nil {
+				return err
+			}
+
+			if resp.GetStatus() != emojify.HealthCheckResponse_SERVING {
+				return fmt.Errorf("emojify status %s", resp.GetStatus())
+			}
+
+			return nil
+		},
+	}
+}
+
+// DependencyStatus is the result of the most recent check of a dependency
+type DependencyStatus struct {
+	Name     string `json:"name"`
+	Critical bool   `json:"critical"`
+	Healthy  bool   `json:"healthy"`
+	// LatencyMS is the duration of the most recent check in milliseconds
+	LatencyMS   float64    `json:"latency_ms"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+	// LastError is the most recent error, it is kept after the dependency
+	// recovers
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	// Breaker is the current state of the circuit breaker [closed,open,half-open]
+	Breaker string `json:"breaker,omitempty"`
+}
+
+// HealthProber checks the health of dependencies in the background and
+// caches the results so that health requests do not call the upstreams
+type HealthProber struct {
+	logger       logging.Logger
+	interval     time.Duration
+	dependencies []Dependency
+	breakers     map[string]*breaker.Breaker
+
+	mutex    sync.RWMutex
+	statuses map[string]*DependencyStatus
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewHealthProber returns a new HealthProber which checks the dependencies
+// every interval once started
+func NewHealthProber(l logging.Logger, interval time.Duration, dependencies ...Dependency) *HealthProber {
+	statuses := map[string]*DependencyStatus{}
+	breakers := map[string]*breaker.Breaker{}
+	for _, d := range dependencies {
+		statuses[d.Name] = &DependencyStatus{Name: d.Name, Critical: d.Critical}
+		if d.Breaker != nil {
+			breakers[d.Name] = d.Breaker
+		}
+	}
+
+	return &HealthProber{
+		logger:       l,
+		interval:     interval,
+		dependencies: dependencies,
+		breakers:     breakers,
+		statuses:     statuses,
+		stop:         make(chan struct{}),
+	}
+}
+
+// Start checks the dependencies immediately and then every interval until
+// Stop is called
+func (h *HealthProber) Start() {
+	h.wg.Add(1)
+
+	go func() {
+		defer h.wg.Done()
+
+		t := time.NewTicker(h.interval)
+		defer t.Stop()
+
+		for {
+			h.probe()
+
+			select {
+			case <-h.stop:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the background checks and waits for any running check to
+// complete
+func (h *HealthProber) Stop() {
+	close(h.stop)
+	h.wg.Wait()
+}
+
+// Ready returns true when every critical dependency has been checked and is
+// healthy
+func (h *HealthProber) Ready() bool {
+	return dependenciesReady(h.Statuses())
+}
+
+// Statuses returns a copy of the status of every dependency sorted by name,
+// the breaker state is the current state rather than the state at the last
+// check
+func (h *HealthProber) Statuses() []DependencyStatus {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	out := make([]DependencyStatus, 0, len(h.statuses))
+	for _, s := range h.statuses {
+		ds := *s
+		if b, ok := h.breakers[s.Name]; ok {
+			ds.Breaker = b.State().String()
+		}
+
+		out = append(out, ds)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	return out
+}
+
+// probe checks every dependency concurrently and records the results
+func (h *HealthProber) probe() {
+	var wg sync.WaitGroup
+
+	for _, d := range h.dependencies {
+		wg.Add(1)
+
+		go func(d Dependency) {
+			defer wg.Done()
+			h.check(d)
+		}(d)
+	}
+
+	wg.Wait()
+}
+
+func (h *HealthProber) check(d Dependency) {
+	done := h.logger.HealthDependencyChecked(d.Name)
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if d.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), d.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	st := time.Now()
+	err := d.Check(ctx)
+	now := time.Now()
+
+	if err != nil {
+		done(http.StatusServiceUnavailable, err)
+	} else {
+		done(http.StatusOK, nil)
+	}
+
+	h.mutex.Lock()
+	s := h.statuses[d.Name]
+	changed := s.LastChecked == nil || s.Healthy != (err == nil)
+
+	s.Healthy = err == nil
+	s.LatencyMS = float64(now.Sub(st)) / float64(time.Millisecond)
+	s.LastChecked = &now
+
+	if err != nil {
+		s.LastError = status.Convert(err).Message()
+		s.LastErrorTime = &now
+	}
+	h.mutex.Unlock()
+
+	if changed {
+		h.logger.HealthDependencyChanged(d.Name, err == nil, err)
+	}
+}
+
+// dependenciesReady returns true when every critical dependency is healthy
+func dependenciesReady(statuses []DependencyStatus) bool {
+	for _, s := range statuses {
+		if s.Critical && !s.Healthy {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/emojify-app/api/breaker"
 	"github.com/emojify-app/api/logging"
 	"github.com/emojify-app/cache/protos/cache"
 	"github.com/emojify-app/emojify/protos/emojify"
@@ -17,7 +21,7 @@ import (
 func setupHealthTests(ce, ee error) (*Health, *httptest.ResponseRecorder, *http.Request) {
 	rw := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/health", nil)
-	l, _ := logging.New("test", "test", "localhost:8125", "error", "text")
+	l := logging.New("test", logging.NewNoopSink(), "error", "text")
 
 	cc := &cache.ClientMock{}
 	cc.On("Check", mock.Anything, mock.Anything, mock.Anything).Return(&cache.HealthCheckResponse{Status: cache.HealthCheckResponse_SERVING}, ce)
@@ -25,7 +29,7 @@ func setupHealthTests(ce, ee error) (*Health, *httptest.ResponseRecorder, *http.
 	ec := &emojify.ClientMock{}
 	ec.On("Check", mock.Anything, mock.Anything, mock.Anything).Return(&emojify.HealthCheckResponse{Status: emojify.HealthCheckResponse_SERVING}, ee)
 
-	return &Health{l, ec, cc}, rw, r
+	return &Health{l, ec, cc, 0, 0}, rw, r
 }
 
 func TestHealthHandlerReturns200(t *testing.T) {
@@ -51,3 +55,130 @@ func TestHealthHandlerReturns500OnEmojifyError(t *testing.T) {
 
 	assert.Equal(t, http.StatusInternalServerError, rw.Code)
 }
+
+func TestHealthHandlerReturns504OnTimeout(t *testing.T) {
+	h, rw, r := setupHealthTests(nil, status.Error(codes.DeadlineExceeded, "timeout"))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+}
+
+func setupHealthProber(ce, ee error, cacheCritical bool) *HealthProber {
+	l := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	cc := &cache.ClientMock{}
+	cc.On("Check", mock.Anything, mock.Anything, mock.Anything).Return(&cache.HealthCheckResponse{Status: cache.HealthCheckResponse_SERVING}, ce)
+
+	ec := &emojify.ClientMock{}
+	ec.On("Check", mock.Anything, mock.Anything, mock.Anything).Return(&emojify.HealthCheckResponse{Status: emojify.HealthCheckResponse_SERVING}, ee)
+
+	return NewHealthProber(l, time.Second,
+		CacheDependency(cc, 0, cacheCritical),
+		EmojifyDependency(ec, 0, true),
+	)
+}
+
+func TestHealthLiveReturns200(t *testing.T) {
+	rw := httptest.NewRecorder()
+
+	NewHealthLive(logging.New("test", logging.NewNoopSink(), "error", "text")).ServeHTTP(rw, httptest.NewRequest("GET", "/health/live", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestHealthReadyReturns503BeforeFirstProbe(t *testing.T) {
+	p := setupHealthProber(nil, nil, false)
+	rw := httptest.NewRecorder()
+
+	NewHealthReady(p.logger, p).ServeHTTP(rw, httptest.NewRequest("GET", "/health/ready", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Contains(t, rw.Body.String(), "not checked")
+}
+
+func TestHealthReadyReturns200WhenNonCriticalDependencyFails(t *testing.T) {
+	p := setupHealthProber(status.Error(codes.Unavailable, "cache down"), nil, false)
+	p.probe()
+	rw := httptest.NewRecorder()
+
+	NewHealthReady(p.logger, p).ServeHTTP(rw, httptest.NewRequest("GET", "/health/ready", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestHealthReadyReturns503WhenCriticalDependencyFails(t *testing.T) {
+	p := setupHealthProber(status.Error(codes.Unavailable, "cache down"), nil, true)
+	p.probe()
+	rw := httptest.NewRecorder()
+
+	NewHealthReady(p.logger, p).ServeHTTP(rw, httptest.NewRequest("GET", "/health/ready", nil))
+
+	er := ErrorResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &er)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "cache down", er.Details["cache"])
+}
+
+func TestHealthDetailsReturnsDependencyStatus(t *testing.T) {
+	p := setupHealthProber(status.Error(codes.Unavailable, "cache down"), nil, false)
+	p.probe()
+	rw := httptest.NewRecorder()
+
+	NewHealthDetails(p.logger, p).ServeHTTP(rw, httptest.NewRequest("GET", "/health/details", nil))
+
+	resp := HealthDetailsResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &resp)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, HealthDegraded, resp.Status)
+	if assert.Len(t, resp.Dependencies, 2) {
+		assert.Equal(t, "cache", resp.Dependencies[0].Name)
+		assert.False(t, resp.Dependencies[0].Healthy)
+		assert.Equal(t, "cache down", resp.Dependencies[0].LastError)
+		assert.NotNil(t, resp.Dependencies[0].LastChecked)
+		assert.True(t, resp.Dependencies[1].Healthy)
+	}
+}
+
+func TestHealthProberCachesResults(t *testing.T) {
+	calls := 0
+	p := NewHealthProber(logging.New("test", logging.NewNoopSink(), "error", "text"), time.Second, Dependency{
+		Name:     "test",
+		Critical: true,
+		Check:    func(ctx context.Context) error { calls++; return nil },
+	})
+	p.probe()
+
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		NewHealthReady(p.logger, p).ServeHTTP(rw, httptest.NewRequest("GET", "/health/ready", nil))
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+
+	assert.Equal(t, 1, calls)
+}
+
+func TestHealthProberStartAndStop(t *testing.T) {
+	p := setupHealthProber(nil, nil, true)
+
+	p.Start()
+	assert.Eventually(t, p.Ready, time.Second, 10*time.Millisecond)
+	p.Stop()
+}
+
+func TestHealthDetailsReportsBreakerState(t *testing.T) {
+	l := logging.New("test", logging.NewNoopSink(), "error", "text")
+	b := breaker.New("emojify", breaker.Config{FailureThreshold: 1, ResetTimeout: time.Minute}, l)
+	b.Call(func() error { return status.Error(codes.Unavailable, "down") })
+
+	p := NewHealthProber(l, time.Second, Dependency{
+		Name:    "emojify",
+		Check:   func(ctx context.Context) error { return nil },
+		Breaker: b,
+	})
+	p.probe()
+
+	assert.Equal(t, "open", p.Statuses()[0].Breaker)
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emojify-app/api/auth"
+)
+
+// IdempotencyKeyHeader is the header clients use to make a POST safe to
+// repeat
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength is the maximum length of an idempotency key
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyRecord is the state of a request made with an idempotency key
+type IdempotencyRecord struct {
+	// Fingerprint identifies the image requested with the key
+	Fingerprint string
+	// Complete is false while the first request with the key is running
+	Complete bool
+	// Response is the response of the first request, set when Complete
+	Response EmojifyResponse
+}
+
+// Idempotency configures idempotency keys for the EmojifyPost handler
+type Idempotency struct {
+	// Store stores the responses of requests made with a key, nil ignores the
+	// Idempotency-Key header
+	Store IdempotencyStore
+	// TrustedProxies are the proxies whose X-Forwarded-For header is used to
+	// find the IP address which scopes the keys of anonymous clients
+	TrustedProxies []*net.IPNet
+}
+
+// IdempotencyStore stores the responses of requests made with an idempotency
+// key
+type IdempotencyStore interface {
+	// Reserve reserves the key for a new request and returns true, when the
+	// key is already reserved or complete the existing record is returned
+	Reserve(key, fingerprint string) (*IdempotencyRecord, bool)
+	// Complete stores the response for a reserved key
+	Complete(key string, resp EmojifyResponse)
+	// Release removes the reservation for a key whose request failed so that
+	// the request can be retried with the same key
+	Release(key string)
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore which keeps records in
+// memory, records expire after the TTL and the oldest record is removed when
+// the store is full
+type MemoryIdempotencyStore struct {
+	ttl        time.Duration
+	maxRecords int
+
+	mutex   sync.Mutex
+	records map[string]*list.Element
+	// order holds the records from oldest to newest, every record has the
+	// same TTL so this is also the order in which they expire
+	order *list.List
+
+	now func() time.Time
+}
+
+type memoryIdempotencyRecord struct {
+	IdempotencyRecord
+	key     string
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore creates a new MemoryIdempotencyStore, records are
+// kept for ttl after the key is first used and at most maxRecords are kept, 0
+// is unlimited
+func NewMemoryIdempotencyStore(ttl time.Duration, maxRecords int) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl:        ttl,
+		maxRecords: maxRecords,
+		records:    map[string]*list.Element{},
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// Reserve implements IdempotencyStore
+func (m *MemoryIdempotencyStore) Reserve(key, fingerprint string) (*IdempotencyRecord, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	if e, ok := m.records[key]; ok {
+		rec := e.Value.(*memoryIdempotencyRecord).IdempotencyRecord
+		return &rec, false
+	}
+
+	if m.maxRecords > 0 && len(m.records) >= m.maxRecords {
+		m.remove(m.order.Front())
+	}
+
+	m.records[key] = m.order.PushBack(&memoryIdempotencyRecord{
+		IdempotencyRecord: IdempotencyRecord{Fingerprint: fingerprint},
+		key:               key,
+		expires:           now.Add(m.ttl),
+	})
+
+	return nil, true
+}
+
+// Complete implements IdempotencyStore
+func (m *MemoryIdempotencyStore) Complete(key string, resp EmojifyResponse) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if e, ok := m.records[key]; ok {
+		r := e.Value.(*memoryIdempotencyRecord)
+		r.Complete = true
+		r.Response = resp
+	}
+}
+
+// Release implements IdempotencyStore
+func (m *MemoryIdempotencyStore) Release(key string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if e, ok := m.records[key]; ok && !e.Value.(*memoryIdempotencyRecord).Complete {
+		m.remove(e)
+	}
+}
+
+// sweep removes expired records from the front of the order, must be called
+// with the mutex held
+func (m *MemoryIdempotencyStore) sweep(now time.Time) {
+	for e := m.order.Front(); e != nil; e = m.order.Front() {
+		if now.Before(e.Value.(*memoryIdempotencyRecord).expires) {
+			return
+		}
+
+		m.remove(e)
+	}
+}
+
+// remove removes the record, must be called with the mutex held
+func (m *MemoryIdempotencyStore) remove(e *list.Element) {
+	delete(m.records, e.Value.(*memoryIdempotencyRecord).key)
+	m.order.Remove(e)
+}
+
+// scopedIdempotencyKey returns the key sent by the client scoped to the
+// authenticated subject, or the IP address of anonymous clients. The IP
+// address is found with the X-Forwarded-For header of requests from trusted
+// proxies.
+func scopedIdempotencyKey(r *http.Request, key string, trusted []*net.IPNet) string {
+	scope := "ip:" + clientIP(r, trusted)
+	if sub := auth.SubjectFromContext(r.Context()); sub != "" {
+		scope = "sub:" + sub
+	}
+
+	// the length prefix prevents a scope and key from colliding with another
+	return fmt.Sprintf("%d:%s%s", len(scope), scope, key)
+}
+
+// requestFingerprint identifies the image requested by er so that reuse of a
+// key for a different image can be detected
+func requestFingerprint(er *emojifyRequest) string {
+	h := sha256.New()
+
+	if er.Image != nil {
+		h.Write([]byte("image:"))
+		h.Write(er.Image)
+	} else {
+		h.Write([]byte("url:"))
+		h.Write([]byte(er.URL))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
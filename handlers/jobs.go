@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emojify-app/api/auth"
+)
+
+// AdminRole is the role which can access the jobs of every client
+const AdminRole = "admin"
+
+// errJobNotOwned is returned when a client requests a job which it does not
+// own
+var errJobNotOwned = errors.New("job is not owned by the client")
+
+// Job is a job created by an authenticated client
+type Job struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+}
+
+// JobStore records the clients which created each job. Job ids are derived
+// from the image URL so the same job can be created by several clients.
+type JobStore interface {
+	// Add records that the job was created by the subject, a job created by an
+	// anonymous client, an empty subject, can be accessed by anyone
+	Add(subject string, job Job)
+	// Owners returns the subjects which created the job, public is true when
+	// the job was created by an anonymous client. A job which is not in the
+	// store has no owners and is not public.
+	Owners(id string) (owners []string, public bool)
+	// List returns the most recent jobs created by the subject, newest first
+	List(subject string, limit int) []Job
+}
+
+// canAccessJob returns true when the client making the request can access the
+// job. Jobs created by an anonymous client can be accessed by anyone and
+// clients with the admin role can access every job. Jobs which are not in the
+// store, because the record has expired or the service has restarted, can
+// only be accessed by admins as the owner is not known. A nil store allows
+// access to every job.
+func canAccessJob(jobs JobStore, r *http.Request, id string) bool {
+	if jobs == nil {
+		return true
+	}
+
+	owners, public := jobs.Owners(id)
+	if public {
+		return true
+	}
+
+	ident := auth.FromContext(r.Context())
+	if ident == nil {
+		return false
+	}
+
+	if ident.HasRole(AdminRole) {
+		return true
+	}
+
+	for _, o := range owners {
+		if o == ident.Subject {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MemoryJobStore is a JobStore which keeps jobs in memory, jobs are forgotten
+// after the TTL or when the service restarts and can then only be accessed by
+// admins until they are created again
+type MemoryJobStore struct {
+	ttl     time.Duration
+	maxJobs int
+
+	mutex     sync.Mutex
+	jobs      map[string]*memoryJobRecord
+	subjects  map[string][]Job
+	nextSweep time.Time
+
+	now func() time.Time
+}
+
+type memoryJobRecord struct {
+	owners  map[string]bool
+	public  bool
+	expires time.Time
+}
+
+// NewMemoryJobStore creates a new MemoryJobStore, ownership is kept for ttl
+// after the job was last created and at most maxJobs are listed for each
+// subject
+func NewMemoryJobStore(ttl time.Duration, maxJobs int) *MemoryJobStore {
+	return &MemoryJobStore{
+		ttl:      ttl,
+		maxJobs:  maxJobs,
+		jobs:     map[string]*memoryJobRecord{},
+		subjects: map[string][]Job{},
+		now:      time.Now,
+	}
+}
+
+// Add implements JobStore
+func (m *MemoryJobStore) Add(subject string, job Job) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	rec, ok := m.jobs[job.ID]
+	if !ok {
+		rec = &memoryJobRecord{owners: map[string]bool{}}
+		m.jobs[job.ID] = rec
+	}
+
+	rec.expires = now.Add(m.ttl)
+
+	if subject == "" {
+		rec.public = true
+		return
+	}
+
+	rec.owners[subject] = true
+
+	// the job moves to the front of the list when it is created again
+	jobs := []Job{job}
+	for _, j := range m.subjects[subject] {
+		if j.ID != job.ID && len(jobs) < m.maxJobs {
+			jobs = append(jobs, j)
+		}
+	}
+
+	m.subjects[subject] = jobs
+}
+
+// Owners implements JobStore
+func (m *MemoryJobStore) Owners(id string) ([]string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rec, ok := m.jobs[id]
+	if !ok || !m.now().Before(rec.expires) {
+		return nil, false
+	}
+
+	owners := make([]string, 0, len(rec.owners))
+	for o := range rec.owners {
+		owners = append(owners, o)
+	}
+	sort.Strings(owners)
+
+	return owners, rec.public
+}
+
+// List implements JobStore
+func (m *MemoryJobStore) List(subject string, limit int) []Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+
+	jobs := []Job{}
+	for _, j := range m.subjects[subject] {
+		if len(jobs) >= limit {
+			break
+		}
+
+		if rec, ok := m.jobs[j.ID]; ok && now.Before(rec.expires) {
+			jobs = append(jobs, j)
+		}
+	}
+
+	return jobs
+}
+
+// sweep removes expired jobs at most once every TTL, must be called with the
+// mutex held
+func (m *MemoryJobStore) sweep(now time.Time) {
+	if now.Before(m.nextSweep) {
+		return
+	}
+
+	for id, rec := range m.jobs {
+		if !now.Before(rec.expires) {
+			delete(m.jobs, id)
+		}
+	}
+
+	for s, jobs := range m.subjects {
+		var live []Job
+		for _, j := range jobs {
+			if _, ok := m.jobs[j.ID]; ok {
+				live = append(live, j)
+			}
+		}
+
+		if len(live) == 0 {
+			delete(m.subjects, s)
+		} else {
+			m.subjects[s] = live
+		}
+	}
+
+	m.nextSweep = now.Add(m.ttl)
+}
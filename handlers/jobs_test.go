@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emojify-app/api/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryJobStoreRecordsOwners(t *testing.T) {
+	s := NewMemoryJobStore(time.Hour, 10)
+
+	s.Add("nic", Job{ID: "abc"})
+	s.Add("erik", Job{ID: "abc"})
+
+	owners, public := s.Owners("abc")
+	assert.Equal(t, []string{"erik", "nic"}, owners)
+	assert.False(t, public)
+
+	s.Add("", Job{ID: "abc"})
+	_, public = s.Owners("abc")
+	assert.True(t, public)
+}
+
+func TestMemoryJobStoreListsRecentJobs(t *testing.T) {
+	s := NewMemoryJobStore(time.Hour, 2)
+
+	s.Add("nic", Job{ID: "a"})
+	s.Add("nic", Job{ID: "b"})
+	s.Add("nic", Job{ID: "a"})
+	s.Add("nic", Job{ID: "c"})
+
+	jobs := s.List("nic", 10)
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, "c", jobs[0].ID)
+	assert.Equal(t, "a", jobs[1].ID)
+
+	assert.Len(t, s.List("nic", 1), 1)
+	assert.Empty(t, s.List("erik", 10))
+}
+
+func TestMemoryJobStoreExpiresJobs(t *testing.T) {
+	s := NewMemoryJobStore(time.Minute, 10)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	s.Add("nic", Job{ID: "abc"})
+
+	now = now.Add(2 * time.Minute)
+	owners, _ := s.Owners("abc")
+	assert.Empty(t, owners)
+	assert.Empty(t, s.List("nic", 10))
+
+	s.Add("erik", Job{ID: "def"})
+	assert.Len(t, s.jobs, 1)
+	assert.NotContains(t, s.subjects, "nic")
+}
+
+func TestCanNotAccessJobAfterRecordExpires(t *testing.T) {
+	s := NewMemoryJobStore(time.Minute, 10)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.Add("nic", Job{ID: "owned"})
+
+	now = now.Add(2 * time.Minute)
+
+	assert.False(t, canAccessJob(s, httptest.NewRequest("GET", "/", nil), "owned"))
+}
+
+func TestCanAccessJob(t *testing.T) {
+	s := NewMemoryJobStore(time.Hour, 10)
+	s.Add("nic", Job{ID: "owned"})
+
+	as := func(ident *auth.Identity, id string) bool {
+		r := httptest.NewRequest("GET", "/", nil)
+		if ident != nil {
+			r = r.WithContext(auth.NewContext(r.Context(), ident))
+		}
+
+		return canAccessJob(s, r, id)
+	}
+
+	assert.True(t, as(&auth.Identity{Subject: "nic"}, "owned"))
+	assert.True(t, as(&auth.Identity{Subject: "erik", Roles: []string{AdminRole}}, "owned"))
+	assert.False(t, as(&auth.Identity{Subject: "erik"}, "owned"))
+	assert.False(t, as(nil, "owned"))
+	s.Add("", Job{ID: "public"})
+
+	assert.True(t, as(nil, "public"))
+	assert.False(t, as(nil, "unknown"))
+	assert.False(t, as(&auth.Identity{Subject: "nic"}, "unknown"))
+	assert.True(t, as(&auth.Identity{Subject: "erik", Roles: []string{AdminRole}}, "unknown"))
+	assert.True(t, canAccessJob(nil, httptest.NewRequest("GET", "/", nil), "owned"))
+}
@@ -3,67 +3,159 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
 
-	hclog "github.com/hashicorp/go-hclog"
+	"github.com/asaskevich/govalidator"
+	"github.com/emojify-app/api/logging"
 )
 
-type paymentHandler struct {
+// maxPaymentSize is the maximum size in bytes of a payment request
+const maxPaymentSize = 4096
+
+// maxGatewayErrorSize is the maximum size in bytes of an error response from
+// the payment gateway which is logged
+const maxGatewayErrorSize = 4096
+
+// Payment is a http.Handler which validates card payments and forwards them to
+// the payment gateway
+type Payment struct {
+	logger            logging.Logger
 	paymentGatewayURI string
-	logger            hclog.Logger
+	client            *http.Client
 }
 
 type paymentRequest struct {
-	FullName string `json:"name" valid:"alpha"`
-	Number   string `json:"number" valid:"numeric"`
-	CVC      string `json:"cvc" valid:"length(3,4)"`
-	Expiry   string `json:"expiry" valid:"length(5,5)"`
-	Type     string `json:"type"`
+	FullName string `json:"name" valid:"required,matches(^[A-Za-z' -]+$)"`
+	Number   string `json:"number" valid:"required,numeric"`
+	CVC      string `json:"cvc" valid:"required,numeric,length(3|4)"`
+	Expiry   string `json:"expiry" valid:"required,length(5|5)"`
+	Type     string `json:"type" valid:"optional"`
 }
 
-func (e paymentHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+// NewPayment returns a new instance of the Payment handler, timeout is the
+// maximum duration to wait for the payment gateway, 0 disables the timeout.
+// Returns an error when paymentGatewayURI is not a http or https URL.
+func NewPayment(l logging.Logger, paymentGatewayURI string, timeout time.Duration) (*Payment, error) {
+	u, err := url.Parse(paymentGatewayURI)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("payment gateway address %q must be a http or https URL", paymentGatewayURI)
+	}
+
+	return &Payment{l, paymentGatewayURI, &http.Client{Timeout: timeout}}, nil
+}
+
+// ServeHTTP implements the handler function
+func (p *Payment) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	logger := p.logger.WithContext(r.Context())
+	done := logger.PaymentHandlerCalled(r)
+
 	var pr paymentRequest
 	if r.Body == nil {
-		http.Error(rw, "Missing request payload", http.StatusBadRequest)
+		err := fmt.Errorf("missing request payload")
+		logger.PaymentHandlerInvalidRequest(err)
+		writeError(rw, r, http.StatusBadRequest, err.Error(), nil)
+		done(http.StatusBadRequest, err)
 		return
 	}
 	defer r.Body.Close()
 
-	json.NewDecoder(r.Body).Decode(&pr)
-
-	/*
-		valid, err := valid.ValidateStruct(&pr)
-		if valid == false || err != nil {
-			e.logger.Info("Invalid JSON payload")
-			http.Error(rw, "Invalid payload", http.StatusBadRequest)
-			return
+	r.Body = http.MaxBytesReader(rw, r.Body, maxPaymentSize)
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		// the error can contain part of the payload, it is only logged
+		st, message := http.StatusBadRequest, "invalid JSON payload"
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			st, message = http.StatusRequestEntityTooLarge, "request body too large"
 		}
-	*/
+
+		logger.PaymentHandlerInvalidRequest(err)
+		writeError(rw, r, st, message, nil)
+		done(st, err)
+		return
+	}
+
+	// the errors returned by govalidator contain the submitted values, only the
+	// field names are logged and returned to avoid leaking card details
+	if _, err := govalidator.ValidateStruct(&pr); err != nil {
+		fields := validationFields(err)
+		verr := fmt.Errorf("invalid payment details: %v", fields)
+
+		logger.PaymentHandlerInvalidRequest(verr)
+		er := newErrorResponse(r, http.StatusBadRequest, "invalid payment details", nil)
+		er.Details = fields
+		er.Write(rw, r)
+		done(http.StatusBadRequest, verr)
+		return
+	}
 
 	data, err := json.Marshal(&pr)
 	if err != nil {
-		e.logger.Error("Unable to encode request body", "error", err)
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		writeError(rw, r, http.StatusInternalServerError, "unable to encode payment request", nil)
+		done(http.StatusInternalServerError, err)
 		return
 	}
 
-	e.logger.Info("Sending request to upstream", "upstream", e.paymentGatewayURI, "request", string(data))
-	resp, err := http.Post(e.paymentGatewayURI, "application/json", bytes.NewReader(data))
+	// the call is cancelled when the client disconnects
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, p.paymentGatewayURI, bytes.NewReader(data))
 	if err != nil {
-		e.logger.Error("Unable to send request to upstream", "upstream", e.paymentGatewayURI, "error", err)
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		writeError(rw, r, http.StatusInternalServerError, "unable to create payment gateway request", nil)
+		done(http.StatusInternalServerError, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	gwDone := logger.PaymentHandlerCallGateway(p.paymentGatewayURI)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		st, message := http.StatusInternalServerError, "unable to contact payment gateway"
+		var uerr *url.Error
+		if errors.As(err, &uerr) && uerr.Timeout() {
+			st, message = http.StatusGatewayTimeout, "timeout contacting payment gateway"
+		}
+
+		gwDone(st, err)
+		writeError(rw, r, st, message, nil)
+		done(st, err)
 		return
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		e.logger.Error("Invalid response from upstream", "upstream", e.paymentGatewayURI, "code", resp.StatusCode, "response", string(body))
-		http.Error(rw, "Invalid response from payment gateway", http.StatusInternalServerError)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxGatewayErrorSize))
+		err := fmt.Errorf("invalid response from payment gateway, code: %d, response: %s", resp.StatusCode, string(body))
+		gwDone(resp.StatusCode, err)
+		writeError(rw, r, http.StatusInternalServerError, "invalid response from payment gateway", nil)
+		done(http.StatusInternalServerError, err)
 		return
 	}
 
-	e.logger.Info("Successfull response from upstream", "upstream", e.paymentGatewayURI)
+	gwDone(http.StatusOK, nil)
+
 	io.Copy(rw, resp.Body)
+	done(http.StatusOK, nil)
+}
+
+// validationFields converts the errors returned from govalidator into a map of
+// field name to failed validator
+func validationFields(err error) map[string]string {
+	fields := map[string]string{}
+
+	switch e := err.(type) {
+	case govalidator.Error:
+		fields[e.Name] = fmt.Sprintf("failed %s validation", e.Validator)
+	case govalidator.Errors:
+		for _, ve := range e.Errors() {
+			for k, v := range validationFields(ve) {
+				fields[k] = v
+			}
+		}
+	}
+
+	return fields
 }
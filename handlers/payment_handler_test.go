@@ -1 +1,120 @@
 package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emojify-app/api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+var validPayment = `{"name":"Nic Jackson","number":"4111111111111111","cvc":"123","expiry":"01/22","type":"visa"}`
+
+func setupPaymentHandler(gatewayStatus int) (*httptest.ResponseRecorder, *http.Request, *Payment, *int) {
+	gatewayCalls := 0
+	gw := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		gatewayCalls++
+		rw.WriteHeader(gatewayStatus)
+		rw.Write([]byte(`{"id":"abc"}`))
+	}))
+
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/payment", nil)
+
+	h, _ := NewPayment(logger, gw.URL, time.Second)
+
+	return rw, r, h, &gatewayCalls
+}
+
+func TestPaymentReturnsBadRequestWhenInvalidJSON(t *testing.T) {
+	rw, r, h, calls := setupPaymentHandler(http.StatusOK)
+	r.Body = ioutil.NopCloser(bytes.NewBufferString("{abc"))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, 0, *calls)
+}
+
+func TestPaymentReturnsBadRequestWithFieldsWhenInvalidCard(t *testing.T) {
+	rw, r, h, calls := setupPaymentHandler(http.StatusOK)
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(`{"name":"Nic Jackson","number":"4111abc","cvc":"12345","expiry":"01/22"}`))
+
+	h.ServeHTTP(rw, r)
+
+	pr := ErrorResponse{}
+	json.Unmarshal(rw.Body.Bytes(), &pr)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, 0, *calls)
+	assert.Contains(t, pr.Details, "number")
+	assert.Contains(t, pr.Details, "cvc")
+	assert.NotContains(t, rw.Body.String(), "4111abc")
+}
+
+func TestPaymentCallsGatewayAndOK(t *testing.T) {
+	rw, r, h, calls := setupPaymentHandler(http.StatusOK)
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(validPayment))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 1, *calls)
+	assert.Equal(t, `{"id":"abc"}`, rw.Body.String())
+}
+
+func TestPaymentReturns500WhenGatewayError(t *testing.T) {
+	rw, r, h, _ := setupPaymentHandler(http.StatusInternalServerError)
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(validPayment))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+}
+
+func TestPaymentReturnsRequestEntityTooLargeWhenBodyTooBig(t *testing.T) {
+	rw, r, h, calls := setupPaymentHandler(http.StatusOK)
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(`{"name":"` + strings.Repeat("a", maxPaymentSize) + `"}`))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Equal(t, 0, *calls)
+}
+
+func TestPaymentReturnsGatewayTimeoutWhenGatewaySlow(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer gw.Close()
+
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+	h, _ := NewPayment(logger, gw.URL, 10*time.Millisecond)
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/payment", bytes.NewBufferString(validPayment))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+}
+
+func TestNewPaymentReturnsErrorWhenAddressNotURL(t *testing.T) {
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	for _, a := range []string{"localhost", "localhost:8080", "ftp://localhost", "http://"} {
+		_, err := NewPayment(logger, a, time.Second)
+		assert.Error(t, err, a)
+	}
+
+	_, err := NewPayment(logger, "http://localhost:8080/", time.Second)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// QuotaRemainingHeader is the response header containing the number of jobs
+// the client can still create
+const QuotaRemainingHeader = "X-Quota-Remaining"
+
+// errQuotaExceeded is returned when the client has created all the jobs
+// allowed by its quota
+var errQuotaExceeded = errors.New("job quota exceeded")
+
+// Quota limits the number of jobs each authenticated client can create,
+// anonymous requests are not limited. Days and months are in UTC.
+type Quota struct {
+	// Daily is the number of jobs a client can create each day, 0 is
+	// unlimited
+	Daily int
+	// Monthly is the number of jobs a client can create each month, 0 is
+	// unlimited
+	Monthly int
+	// Store records the jobs created by each client
+	Store QuotaStore
+}
+
+// QuotaUsage is the number of jobs a client has created in the current period
+type QuotaUsage struct {
+	Daily   int
+	Monthly int
+}
+
+// QuotaStore records the number of jobs created by each client
+type QuotaStore interface {
+	// Usage returns the jobs created by the subject in the day and month
+	// containing t
+	Usage(subject string, t time.Time) (QuotaUsage, error)
+	// Consume records a job created by the subject at t and returns the new
+	// usage
+	Consume(subject string, t time.Time) (QuotaUsage, error)
+}
+
+// remaining returns the number of jobs which can be created with the usage,
+// -1 is unlimited
+func (q *Quota) remaining(u QuotaUsage) int {
+	r := -1
+
+	if q.Daily > 0 {
+		r = max(q.Daily-u.Daily, 0)
+	}
+
+	if q.Monthly > 0 && (r < 0 || q.Monthly-u.Monthly < r) {
+		r = max(q.Monthly-u.Monthly, 0)
+	}
+
+	return r
+}
+
+// period returns the period whose limit is exhausted by the usage
+func (q *Quota) period(u QuotaUsage) string {
+	if q.Daily > 0 && u.Daily >= q.Daily {
+		return "daily"
+	}
+
+	return "monthly"
+}
+
+// quotaPeriods returns the day and month containing t
+func quotaPeriods(t time.Time) (string, string) {
+	t = t.UTC()
+	return t.Format("2006-01-02"), t.Format("2006-01")
+}
+
+// quotaRecord is the usage of a client in the stored day and month, the
+// counts reset when the period changes
+type quotaRecord struct {
+	Day     string `json:"day"`
+	Daily   int    `json:"daily"`
+	Month   string `json:"month"`
+	Monthly int    `json:"monthly"`
+}
+
+// usage returns the usage in the day and month containing t
+func (r quotaRecord) usage(t time.Time) QuotaUsage {
+	day, month := quotaPeriods(t)
+
+	var u QuotaUsage
+	if r.Day == day {
+		u.Daily = r.Daily
+	}
+
+	if r.Month == month {
+		u.Monthly = r.Monthly
+	}
+
+	return u
+}
+
+// consume returns the record with a job created at t
+func (r quotaRecord) consume(t time.Time) quotaRecord {
+	u := r.usage(t)
+	day, month := quotaPeriods(t)
+
+	return quotaRecord{Day: day, Daily: u.Daily + 1, Month: month, Monthly: u.Monthly + 1}
+}
+
+// MemoryQuotaStore is a QuotaStore which keeps usage in memory, usage is lost
+// when the service restarts
+type MemoryQuotaStore struct {
+	mutex   sync.Mutex
+	records map[string]quotaRecord
+}
+
+// NewMemoryQuotaStore creates a new MemoryQuotaStore
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{records: map[string]quotaRecord{}}
+}
+
+// Usage implements QuotaStore
+func (m *MemoryQuotaStore) Usage(subject string, t time.Time) (QuotaUsage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.records[subject].usage(t), nil
+}
+
+// Consume implements QuotaStore
+func (m *MemoryQuotaStore) Consume(subject string, t time.Time) (QuotaUsage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := m.records[subject].consume(t)
+	m.records[subject] = r
+
+	return r.usage(t), nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var quotaBucket = []byte("quota")
+
+// BoltQuotaStore is a QuotaStore which keeps usage in a BoltDB file so that it
+// survives restarts, the file can only be opened by one process
+type BoltQuotaStore struct {
+	db *bolt.DB
+}
+
+// NewBoltQuotaStore opens or creates the BoltDB file at path
+func NewBoltQuotaStore(path string) (*BoltQuotaStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(quotaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltQuotaStore{db}, nil
+}
+
+// Usage implements QuotaStore
+func (b *BoltQuotaStore) Usage(subject string, t time.Time) (QuotaUsage, error) {
+	var r quotaRecord
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return getQuotaRecord(tx, subject, &r)
+	})
+
+	return r.usage(t), err
+}
+
+// Consume implements QuotaStore
+func (b *BoltQuotaStore) Consume(subject string, t time.Time) (QuotaUsage, error) {
+	var r quotaRecord
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := getQuotaRecord(tx, subject, &r); err != nil {
+			return err
+		}
+
+		r = r.consume(t)
+
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(quotaBucket).Put([]byte(subject), data)
+	})
+
+	return r.usage(t), err
+}
+
+// Close closes the BoltDB file
+func (b *BoltQuotaStore) Close() error {
+	return b.db.Close()
+}
+
+func getQuotaRecord(tx *bolt.Tx, subject string, r *quotaRecord) error {
+	data := tx.Bucket(quotaBucket).Get([]byte(subject))
+	if data == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, r)
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/emojify/protos/emojify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func postAs(h *EmojifyPost, subject string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(fileURL))
+	if subject != "" {
+		r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: subject}))
+	}
+
+	h.ServeHTTP(rw, r)
+
+	return rw
+}
+
+func TestQuotaRemainingUsesLowestLimit(t *testing.T) {
+	q := &Quota{Daily: 5, Monthly: 20}
+
+	assert.Equal(t, 5, q.remaining(QuotaUsage{Daily: 0, Monthly: 0}))
+	assert.Equal(t, 2, q.remaining(QuotaUsage{Daily: 3, Monthly: 18}))
+	assert.Equal(t, 0, q.remaining(QuotaUsage{Daily: 1, Monthly: 25}))
+	assert.Equal(t, "monthly", q.period(QuotaUsage{Daily: 1, Monthly: 20}))
+	assert.Equal(t, -1, (&Quota{}).remaining(QuotaUsage{Daily: 100}))
+}
+
+func TestQuotaStoresResetUsageEachPeriod(t *testing.T) {
+	bs, err := NewBoltQuotaStore(filepath.Join(t.TempDir(), "quota.db"))
+	assert.NoError(t, err)
+	defer bs.Close()
+
+	for name, s := range map[string]QuotaStore{"memory": NewMemoryQuotaStore(), "bolt": bs} {
+		day := time.Date(2026, 10, 31, 12, 0, 0, 0, time.UTC)
+
+		s.Consume("nic", day)
+		u, err := s.Consume("nic", day)
+		assert.NoError(t, err, name)
+		assert.Equal(t, QuotaUsage{Daily: 2, Monthly: 2}, u, name)
+
+		u, _ = s.Usage("nic", day.Add(-24*time.Hour))
+		assert.Equal(t, QuotaUsage{Daily: 0, Monthly: 2}, u, name)
+
+		u, _ = s.Usage("nic", day.Add(24*time.Hour))
+		assert.Equal(t, QuotaUsage{}, u, name)
+
+		u, _ = s.Usage("erik", day)
+		assert.Equal(t, QuotaUsage{}, u, name)
+	}
+}
+
+func TestBoltQuotaStorePersistsUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.db")
+	now := time.Now()
+
+	bs, _ := NewBoltQuotaStore(path)
+	bs.Consume("nic", now)
+	bs.Close()
+
+	bs, err := NewBoltQuotaStore(path)
+	assert.NoError(t, err)
+	defer bs.Close()
+
+	u, _ := bs.Usage("nic", now)
+	assert.Equal(t, QuotaUsage{Daily: 1, Monthly: 1}, u)
+}
+
+func TestReturns429WhenQuotaExceeded(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+	h.quota = &Quota{Daily: 1, Store: NewMemoryQuotaStore()}
+
+	first := postAs(h, "nic")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "0", first.Header().Get(QuotaRemainingHeader))
+
+	second := postAs(h, "nic")
+	assert.Equal(t, http.StatusTooManyRequests, second.Code)
+	assert.Equal(t, "0", second.Header().Get(QuotaRemainingHeader))
+	mockEmojifyer.AssertNumberOfCalls(t, "Create", 1)
+}
+
+func TestDoesNotUploadImageWhenQuotaExceeded(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+	h.quota = &Quota{Daily: 1, Store: NewMemoryQuotaStore()}
+	h.quota.Store.Consume("nic", time.Now())
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", bytes.NewBuffer(pngData))
+	r.Header.Set("Content-Type", "image/png")
+	r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: "nic"}))
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	mockUploadCache.AssertNotCalled(t, "Put", mock.Anything, mock.Anything, mock.Anything)
+	mockEmojifyer.AssertNotCalled(t, "Create", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestQuotaIsOnlyConsumedWhenJobCreated(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+	h.quota = &Quota{Daily: 1, Store: NewMemoryQuotaStore()}
+	resetEmojifyMock()
+	mockEmojifyer.On("Create", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("boom")).Once()
+	mockEmojifyer.On("Create", mock.Anything, mock.Anything, mock.Anything).Return(&emojify.QueryItem{Id: "abc"}, nil)
+
+	failed := postAs(h, "nic")
+	assert.Equal(t, http.StatusInternalServerError, failed.Code)
+	assert.Equal(t, "1", failed.Header().Get(QuotaRemainingHeader))
+
+	assert.Equal(t, http.StatusOK, postAs(h, "nic").Code)
+}
+
+func TestQuotaDoesNotLimitAnonymousRequests(t *testing.T) {
+	_, _, h := setupEmojiPostHandler()
+	h.quota = &Quota{Daily: 1, Store: NewMemoryQuotaStore()}
+
+	postAs(h, "")
+	rw := postAs(h, "")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Empty(t, rw.Header().Get(QuotaRemainingHeader))
+}
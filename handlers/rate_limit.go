@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/logging"
+)
+
+// Client keys for rate limiting
+const (
+	// RateLimitKeyIP limits each client IP address
+	RateLimitKeyIP = "ip"
+	// RateLimitKeyAPIKey limits each client authenticated with an API key,
+	// other requests are limited by IP address
+	RateLimitKeyAPIKey = "api_key"
+	// RateLimitKeySubject limits each authenticated subject, anonymous
+	// requests are limited by IP address
+	RateLimitKeySubject = "subject"
+)
+
+// RateLimit configures the token bucket for a group of routes
+type RateLimit struct {
+	// Rate is the number of requests per second a client can make
+	Rate float64
+	// Burst is the number of requests a client can make at once
+	Burst int
+	// Key identifies the client [ip,api_key,subject]
+	Key string
+	// Authenticated is true when requests to the route group are
+	// authenticated, required by the api_key and subject keys
+	Authenticated bool
+	// TrustedProxies are the networks of the proxies in front of the API, the
+	// X-Forwarded-For header is only read from requests sent by a trusted
+	// proxy
+	TrustedProxies []*net.IPNet
+}
+
+// RateLimiter is a middleware which limits the rate of requests from each
+// client with a token bucket
+type RateLimiter struct {
+	logger logging.Logger
+	group  string
+	config RateLimit
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	nextSweep time.Time
+
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a new RateLimiter for the route group, the group is
+// used to tag metrics
+func NewRateLimiter(l logging.Logger, group string, c RateLimit) (*RateLimiter, error) {
+	if c.Rate <= 0 || c.Burst < 1 {
+		return nil, fmt.Errorf("rate limit for %s must have a positive rate and burst", group)
+	}
+
+	switch c.Key {
+	case RateLimitKeyIP, RateLimitKeyAPIKey, RateLimitKeySubject:
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %s [ip,api_key,subject]", c.Key)
+	}
+
+	if c.Key != RateLimitKeyIP && !c.Authenticated {
+		return nil, fmt.Errorf("rate limit key %s for %s requires authentication", c.Key, group)
+	}
+
+	return &RateLimiter{
+		logger:  l,
+		group:   group,
+		config:  c,
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}, nil
+}
+
+// Middleware is used by gorilla/mux to create a middleware, every response
+// contains the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers, rejected requests return 429 with a Retry-After header
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := rl.clientKey(r)
+		ok, remaining, reset, retry := rl.take(key)
+
+		rw.Header().Set("RateLimit-Limit", strconv.Itoa(rl.config.Burst))
+		rw.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		rw.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+
+		if !ok {
+			rl.logger.WithContext(r.Context()).RateLimitRejected(rl.group, key)
+
+			rw.Header().Set("Retry-After", strconv.Itoa(seconds(retry)))
+			writeError(rw, r, http.StatusTooManyRequests, "rate limit exceeded", nil)
+			return // do not call next
+		}
+
+		// handlers which create several jobs for one request charge the
+		// bucket for each extra job with takeRateLimit
+		ctx := context.WithValue(r.Context(), rateLimitContextKey{}, &rateLimitCharge{rl, key})
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+type rateLimitContextKey struct{}
+
+// rateLimitCharge is the bucket of the client which made a request
+type rateLimitCharge struct {
+	limiter *RateLimiter
+	key     string
+}
+
+// takeRateLimit removes a token from the bucket of the client making the
+// request for work done after the request was admitted, such as each job in a
+// batch or each job created over a WebSocket. Returns false when the bucket
+// is empty, requests which are not rate limited always return true.
+func takeRateLimit(r *http.Request) bool {
+	c, ok := r.Context().Value(rateLimitContextKey{}).(*rateLimitCharge)
+	if !ok {
+		return true
+	}
+
+	if allowed, _, _, _ := c.limiter.take(c.key); !allowed {
+		c.limiter.logger.WithContext(r.Context()).RateLimitRejected(c.limiter.group, c.key)
+		return false
+	}
+
+	return true
+}
+
+// take removes a token from the bucket for the key, it returns false when
+// the bucket is empty. The remaining tokens, the time until the bucket is
+// full and the time until the next token is available are also returned.
+func (rl *RateLimiter) take(key string) (bool, int, time.Duration, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rl.config.Burst), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = rl.refill(b, now)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	var retry time.Duration
+	if b.tokens < 1 {
+		retry = rl.duration(1 - b.tokens)
+	}
+
+	reset := rl.duration(float64(rl.config.Burst) - b.tokens)
+
+	return allowed, int(b.tokens), reset, retry
+}
+
+// peek returns true when the bucket for the key has a token without removing
+// it, the time until the next token is available is also returned
+func (rl *RateLimiter) peek(key string) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		return true, 0
+	}
+
+	tokens := rl.refill(b, rl.now())
+	if tokens >= 1 {
+		return true, 0
+	}
+
+	return false, rl.duration(1 - tokens)
+}
+
+// refill returns the tokens in the bucket at now
+func (rl *RateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	t := b.tokens + now.Sub(b.last).Seconds()*rl.config.Rate
+	return math.Min(t, float64(rl.config.Burst))
+}
+
+// duration returns the time taken to add tokens to a bucket
+func (rl *RateLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.config.Rate * float64(time.Second))
+}
+
+// sweep removes buckets which have refilled, a full bucket is the same as a
+// new one, at most once every refill period. Must be called with the mutex
+// held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Before(rl.nextSweep) {
+		return
+	}
+
+	for k, b := range rl.buckets {
+		if rl.refill(b, now) >= float64(rl.config.Burst) {
+			delete(rl.buckets, k)
+		}
+	}
+
+	rl.nextSweep = now.Add(rl.duration(float64(rl.config.Burst)))
+}
+
+// clientKey returns the key which identifies the client making the request,
+// only authenticated identities are used so a client can not get a new bucket
+// by sending different credentials
+func (rl *RateLimiter) clientKey(r *http.Request) string {
+	switch rl.config.Key {
+	case RateLimitKeyAPIKey:
+		if id := auth.FromContext(r.Context()); id != nil && id.Method == auth.MethodAPIKey {
+			return "key:" + id.Subject
+		}
+	case RateLimitKeySubject:
+		if sub := auth.SubjectFromContext(r.Context()); sub != "" {
+			return "sub:" + sub
+		}
+	}
+
+	return "ip:" + clientIP(r, rl.config.TrustedProxies)
+}
+
+// ClientIP returns a function which finds the IP address of the client
+// making a request in the same way as the rate limiter, the X-Forwarded-For
+// header is only read from requests sent by a trusted proxy
+func ClientIP(trusted []*net.IPNet) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return clientIP(r, trusted)
+	}
+}
+
+// clientIP returns the IP address of the client making the request. When the
+// request is sent by a trusted proxy the X-Forwarded-For header is read from
+// the right, skipping trusted proxies, the leftmost entries are set by the
+// client and can not be trusted.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !containsIP(trusted, net.ParseIP(host)) {
+		return host
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// the header has been altered, use the last address which was
+			// added by a trusted proxy
+			break
+		}
+
+		host = ip.String()
+		if !containsIP(trusted, ip) {
+			break
+		}
+	}
+
+	return host
+}
+
+// containsIP returns true when the ip is in one of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// seconds rounds a duration up to whole seconds for a header value
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupRateLimiter(t *testing.T, c RateLimit) (*RateLimiter, http.Handler, *time.Time) {
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	rl, err := NewRateLimiter(logger, "emojify", c)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+
+	h := rl.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	return rl, h, &now
+}
+
+func rateLimitedRequest(h http.Handler, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = remoteAddr
+
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	h.ServeHTTP(rw, r)
+
+	return rw
+}
+
+func TestNewRateLimiterReturnsErrorForInvalidConfig(t *testing.T) {
+	logger := logging.New("test", logging.NewNoopSink(), "error", "text")
+
+	_, err := NewRateLimiter(logger, "emojify", RateLimit{Rate: 0, Burst: 1, Key: RateLimitKeyIP})
+	assert.Error(t, err)
+
+	_, err = NewRateLimiter(logger, "emojify", RateLimit{Rate: 1, Burst: 1, Key: "cookie"})
+	assert.Error(t, err)
+
+	_, err = NewRateLimiter(logger, "emojify", RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeyAPIKey})
+	assert.Error(t, err)
+}
+
+func TestRateLimiterAllowsBurstThenReturns429(t *testing.T) {
+	_, h, _ := setupRateLimiter(t, RateLimit{Rate: 0.5, Burst: 2, Key: RateLimitKeyIP})
+
+	first := rateLimitedRequest(h, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "2", first.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", first.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2", first.Header().Get("RateLimit-Reset"))
+
+	second := rateLimitedRequest(h, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "0", second.Header().Get("RateLimit-Remaining"))
+
+	third := rateLimitedRequest(h, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusTooManyRequests, third.Code)
+	assert.Equal(t, "2", third.Header().Get("Retry-After"))
+	assert.Equal(t, "4", third.Header().Get("RateLimit-Reset"))
+}
+
+func TestRateLimiterRefillsTokens(t *testing.T) {
+	_, h, now := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeyIP})
+
+	rateLimitedRequest(h, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rateLimitedRequest(h, "10.0.0.1:1234", nil).Code)
+
+	*now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, rateLimitedRequest(h, "10.0.0.1:1234", nil).Code)
+}
+
+func TestRateLimiterLimitsEachIPSeparately(t *testing.T) {
+	_, h, _ := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeyIP})
+
+	rateLimitedRequest(h, "10.0.0.1:1234", nil)
+
+	assert.Equal(t, http.StatusOK, rateLimitedRequest(h, "10.0.0.2:1234", nil).Code)
+}
+
+func TestRateLimiterIgnoresForwardedForUnlessTrusted(t *testing.T) {
+	_, h, _ := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeyIP})
+
+	rateLimitedRequest(h, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"})
+	rw := rateLimitedRequest(h, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "2.2.2.2"})
+
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+}
+
+func trustedProxies() []*net.IPNet {
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	return []*net.IPNet{n}
+}
+
+func TestRateLimiterUsesForwardedForFromTrustedProxy(t *testing.T) {
+	_, h, _ := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeyIP, TrustedProxies: trustedProxies()})
+
+	rateLimitedRequest(h, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 10.0.0.5"})
+	rw := rateLimitedRequest(h, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "2.2.2.2, 10.0.0.5"})
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestRateLimiterIgnoresForwardedForSetByClient(t *testing.T) {
+	_, h, _ := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeyIP, TrustedProxies: trustedProxies()})
+
+	rateLimitedRequest(h, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 3.3.3.3"})
+	rw := rateLimitedRequest(h, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "2.2.2.2, 3.3.3.3"})
+
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+}
+
+func TestClientIPUsesForwardedForFromTrustedProxy(t *testing.T) {
+	ip := ClientIP(trustedProxies())
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 10.0.0.5")
+	assert.Equal(t, "1.1.1.1", ip(r))
+
+	r.RemoteAddr = "3.3.3.3:1234"
+	assert.Equal(t, "3.3.3.3", ip(r))
+}
+
+func TestRateLimiterIgnoresForwardedForFromUntrustedAddress(t *testing.T) {
+	_, h, _ := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeyIP, TrustedProxies: trustedProxies()})
+
+	rateLimitedRequest(h, "3.3.3.3:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"})
+	rw := rateLimitedRequest(h, "3.3.3.3:1234", map[string]string{"X-Forwarded-For": "2.2.2.2"})
+
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+}
+
+func TestRateLimiterLimitsEachAPIKey(t *testing.T) {
+	_, h, _ := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeyAPIKey, Authenticated: true})
+
+	request := func(id *auth.Identity, remoteAddr string) int {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set(auth.APIKeyHeader, "made-up")
+		if id != nil {
+			r = r.WithContext(auth.NewContext(r.Context(), id))
+		}
+
+		h.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	request(&auth.Identity{Subject: "nic", Method: auth.MethodAPIKey}, "10.0.0.1:1234")
+
+	assert.Equal(t, http.StatusOK, request(&auth.Identity{Subject: "erik", Method: auth.MethodAPIKey}, "10.0.0.1:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, request(&auth.Identity{Subject: "nic", Method: auth.MethodAPIKey}, "10.0.0.2:1234"))
+}
+
+func TestRateLimiterLimitsUnauthenticatedAPIKeysByIP(t *testing.T) {
+	_, h, _ := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeyAPIKey, Authenticated: true})
+
+	rateLimitedRequest(h, "10.0.0.1:1234", map[string]string{auth.APIKeyHeader: "abc"})
+	rw := rateLimitedRequest(h, "10.0.0.1:1234", map[string]string{auth.APIKeyHeader: "def"})
+
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+}
+
+func TestRateLimiterRemovesRefilledBuckets(t *testing.T) {
+	rl, h, now := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 2, Key: RateLimitKeyIP})
+
+	rateLimitedRequest(h, "10.0.0.1:1234", nil)
+	rateLimitedRequest(h, "10.0.0.2:1234", nil)
+	assert.Len(t, rl.buckets, 2)
+
+	*now = now.Add(3 * time.Second)
+	rateLimitedRequest(h, "10.0.0.3:1234", nil)
+
+	assert.Len(t, rl.buckets, 1)
+}
+
+func TestRateLimiterLimitsEachSubject(t *testing.T) {
+	_, h, _ := setupRateLimiter(t, RateLimit{Rate: 1, Burst: 1, Key: RateLimitKeySubject, Authenticated: true})
+
+	request := func(subject, remoteAddr string) int {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = remoteAddr
+		r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: subject}))
+
+		h.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	request("nic", "10.0.0.1:1234")
+
+	assert.Equal(t, http.StatusOK, request("erik", "10.0.0.1:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, request("nic", "10.0.0.2:1234"))
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URLPolicy defines which URLs can be submitted to the emojify service, the
+// emojify service fetches submitted URLs from inside our network so anything
+// which resolves to an internal address must be rejected.
+//
+// The policy is checked when the URL is submitted, the emojify service
+// resolves the host again when fetching so a DNS record which changes between
+// the two lookups is not caught here.
+type URLPolicy struct {
+	// AllowedSchemes is the list of permitted URL schemes
+	AllowedSchemes []string
+	// AllowedHosts restricts URLs to the given hosts, entries starting with *.
+	// match any subdomain, an empty list allows any host
+	AllowedHosts []string
+	// DeniedHosts are never permitted, entries starting with *. match any
+	// subdomain
+	DeniedHosts []string
+	// AllowedPorts restricts URLs to the given ports, an empty list allows any
+	// port
+	AllowedPorts []int
+	// AllowPrivateIPs permits hosts which resolve to loopback, link-local,
+	// private or otherwise non public addresses
+	AllowPrivateIPs bool
+	// LookupIPAddr resolves host names, defaults to net.DefaultResolver
+	LookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// URLRejectedError is returned when a URL does not satisfy the URLPolicy, the
+// error is returned to the client so Detail contains information which must
+// only be logged, such as the internal address a host resolves to
+type URLRejectedError struct {
+	URL    string
+	Reason string
+	Detail string
+}
+
+func (u *URLRejectedError) Error() string {
+	return fmt.Sprintf("%s is not permitted: %s", u.URL, u.Reason)
+}
+
+// DefaultURLPolicy returns a URLPolicy which permits http and https URLs on
+// the default ports for public hosts
+func DefaultURLPolicy() *URLPolicy {
+	return &URLPolicy{
+		AllowedSchemes: []string{"http", "https"},
+		AllowedPorts:   []int{80, 443},
+	}
+}
+
+// Check returns a URLRejectedError when the URL is not permitted by the policy
+func (p *URLPolicy) Check(ctx context.Context, u *url.URL) error {
+	reject := func(format string, a ...interface{}) error {
+		return &URLRejectedError{URL: u.String(), Reason: fmt.Sprintf(format, a...)}
+	}
+
+	if !containsString(p.AllowedSchemes, strings.ToLower(u.Scheme)) {
+		return reject("scheme %s is not allowed", u.Scheme)
+	}
+
+	host := normalizeHost(u.Hostname())
+	if host == "" {
+		return reject("missing host")
+	}
+
+	if matchesHost(p.DeniedHosts, host) {
+		return reject("host %s is denied", host)
+	}
+
+	if len(p.AllowedHosts) > 0 && !matchesHost(p.AllowedHosts, host) {
+		return reject("host %s is not allowed", host)
+	}
+
+	if len(p.AllowedPorts) > 0 {
+		port, err := urlPort(u)
+		if err != nil || !containsInt(p.AllowedPorts, port) {
+			return reject("port %s is not allowed", u.Port())
+		}
+	}
+
+	if p.AllowPrivateIPs {
+		return nil
+	}
+
+	// check every address the host resolves to, a host with one public and
+	// one private record must be rejected
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		lookup := p.LookupIPAddr
+		if lookup == nil {
+			lookup = net.DefaultResolver.LookupIPAddr
+		}
+
+		var err error
+		if addrs, err = lookup(ctx, host); err != nil || len(addrs) == 0 {
+			return reject("unable to resolve host %s", host)
+		}
+	}
+
+	for _, a := range addrs {
+		if !isPublicIP(a.IP) {
+			return &URLRejectedError{
+				URL:    u.String(),
+				Reason: "URL is not allowed",
+				Detail: fmt.Sprintf("host %s resolves to non public address %s", host, a.IP),
+			}
+		}
+	}
+
+	return nil
+}
+
+// reservedNetworks are special purpose IPv4 ranges which are not covered by
+// the methods of net.IP
+var reservedNetworks = []*net.IPNet{
+	// this network, RFC 1122
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	// shared address space, RFC 6598
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	// benchmarking, RFC 2544
+	{IP: net.IPv4(198, 18, 0, 0), Mask: net.CIDRMask(15, 32)},
+	// reserved and limited broadcast, RFC 1112 and RFC 919
+	{IP: net.IPv4(240, 0, 0, 0), Mask: net.CIDRMask(4, 32)},
+}
+
+// IPv6 ranges which embed an IPv4 address, traffic to them can reach the
+// embedded address through a translator or relay
+var (
+	// NAT64 well-known prefix, RFC 6052, the last 4 bytes are the address
+	nat64Network = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+	// 6to4, RFC 3056, bytes 2 to 5 are the address
+	sixToFourNetwork = &net.IPNet{IP: net.ParseIP("2002::"), Mask: net.CIDRMask(16, 128)}
+)
+
+func isPublicIP(ip net.IP) bool {
+	switch {
+	case ip.To4() != nil:
+	case nat64Network.Contains(ip):
+		return isPublicIP(net.IP(ip[12:16]))
+	case sixToFourNetwork.Contains(ip):
+		return isPublicIP(net.IP(ip[2:6]))
+	}
+
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return !(ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified())
+}
+
+// urlPort returns the port for the URL, using the scheme default when the URL
+// does not contain a port
+func urlPort(u *url.URL) (int, error) {
+	if p := u.Port(); p != "" {
+		return strconv.Atoi(p)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return 80, nil
+	case "https":
+		return 443, nil
+	}
+
+	return 0, fmt.Errorf("no default port for scheme %s", u.Scheme)
+}
+
+// normalizeHost lowercases the host and removes the trailing dot of a fully
+// qualified name so that both forms match the same entries in the host lists
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func matchesHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		h = normalizeHost(h)
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if strings.ToLower(l) == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsInt(list []int, i int) bool {
+	for _, l := range list {
+		if l == i {
+			return true
+		}
+	}
+
+	return false
+}
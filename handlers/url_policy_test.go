@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func checkURL(p *URLPolicy, uri string) error {
+	u, _ := url.Parse(uri)
+	return p.Check(context.Background(), u)
+}
+
+func TestURLPolicyAllowsPublicHost(t *testing.T) {
+	assert.NoError(t, checkURL(testURLPolicy(), "https://something.com/a.jpg"))
+}
+
+func TestURLPolicyRejectsScheme(t *testing.T) {
+	assert.Error(t, checkURL(testURLPolicy(), "file:///etc/passwd"))
+	assert.Error(t, checkURL(testURLPolicy(), "gopher://something.com/"))
+}
+
+func TestURLPolicyRejectsPorts(t *testing.T) {
+	assert.Error(t, checkURL(testURLPolicy(), "http://something.com:6379/"))
+	assert.NoError(t, checkURL(testURLPolicy(), "http://something.com:443/"))
+}
+
+func TestURLPolicyRejectsNonPublicAddresses(t *testing.T) {
+	for _, u := range []string{
+		"http://127.0.0.1/",
+		"http://localhost.internal/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.1.2.3/",
+		"http://192.168.0.1/",
+		"http://100.64.0.1/",
+		"http://[::1]/",
+		"http://[fe80::1]/",
+		"http://0.0.0.0/",
+	} {
+		assert.Error(t, checkURL(testURLPolicy(), u), u)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	cases := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"2001:4860:4860::8888", true},
+		{"64:ff9b::8.8.8.8", true},
+		{"64:ff9b::127.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"2002:0808:0808::1", true},
+		{"2002:7f00:0001::1", false},
+		{"2002:0a00:0001::1", false},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.public, isPublicIP(net.ParseIP(tc.ip)), tc.ip)
+	}
+}
+
+func TestURLPolicyRejectsEmbeddedIPv4Addresses(t *testing.T) {
+	assert.Error(t, checkURL(testURLPolicy(), "http://[64:ff9b::169.254.169.254]/"))
+	assert.Error(t, checkURL(testURLPolicy(), "http://[2002:a9fe:a9fe::1]/"))
+}
+
+func TestURLPolicyDoesNotReturnResolvedAddress(t *testing.T) {
+	err := checkURL(testURLPolicy(), "http://localhost.internal/")
+
+	rerr, ok := err.(*URLRejectedError)
+	assert.True(t, ok)
+	assert.NotContains(t, err.Error(), "10.0.0.1")
+	assert.Equal(t, "URL is not allowed", rerr.Reason)
+	assert.Contains(t, rerr.Detail, "10.0.0.1")
+}
+
+func TestURLPolicyAllowsPrivateAddressesWhenEnabled(t *testing.T) {
+	p := testURLPolicy()
+	p.AllowPrivateIPs = true
+
+	assert.NoError(t, checkURL(p, "http://10.1.2.3/"))
+}
+
+func TestURLPolicyHostLists(t *testing.T) {
+	p := testURLPolicy()
+	p.AllowedHosts = []string{"*.example.com", "images.com"}
+	p.DeniedHosts = []string{"bad.example.com"}
+
+	assert.NoError(t, checkURL(p, "http://cdn.example.com/a.png"))
+	assert.NoError(t, checkURL(p, "http://IMAGES.com/a.png"))
+	assert.Error(t, checkURL(p, "http://bad.example.com/a.png"))
+	assert.Error(t, checkURL(p, "http://other.com/a.png"))
+	assert.Error(t, checkURL(p, "http://notexample.com/a.png"))
+}
+
+func TestURLPolicyHostListsIgnoreTrailingDot(t *testing.T) {
+	cases := []struct {
+		allowed []string
+		denied  []string
+		url     string
+		ok      bool
+	}{
+		{nil, []string{"bad.example.com"}, "http://bad.example.com./a.png", false},
+		{nil, []string{"*.example.com"}, "http://cdn.example.com./a.png", false},
+		{nil, []string{"Bad.Example.com."}, "http://BAD.example.com/a.png", false},
+		{[]string{"images.com"}, nil, "http://images.com./a.png", true},
+		{[]string{"images.com."}, nil, "http://IMAGES.com/a.png", true},
+		{[]string{"*.example.com"}, nil, "http://cdn.example.com./a.png", true},
+	}
+
+	for _, tc := range cases {
+		p := testURLPolicy()
+		p.AllowedHosts = tc.allowed
+		p.DeniedHosts = tc.denied
+
+		err := checkURL(p, tc.url)
+		assert.Equal(t, tc.ok, err == nil, tc.url)
+	}
+}
@@ -0,0 +1,292 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emojify-app/api/requestid"
+	"github.com/gorilla/mux"
+)
+
+// Access log formats which can be passed to NewAccessLog
+const (
+	AccessLogNone   = "none"
+	AccessLogCLF    = "clf"
+	AccessLogJSON   = "json"
+	AccessLogLogfmt = "logfmt"
+)
+
+// clfTime is the time format used by the Common Log Format
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogConfig configures the AccessLog middleware
+type AccessLogConfig struct {
+	// Format is one of [none,clf,json,logfmt]
+	Format string
+	// SampleRate is the fraction of requests which are logged, requests which
+	// fail with a 5xx status are always logged
+	SampleRate float64
+	// ExcludePaths are not logged, a path also excludes any path below it
+	ExcludePaths []string
+	// ClientIP returns the address of the client which made the request, such
+	// as the address forwarded by a trusted proxy, nil uses the host of the
+	// remote address
+	ClientIP func(r *http.Request) string
+}
+
+// AccessLogEntry contains the details of a single request
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Route      string    `json:"route"`
+	Protocol   string    `json:"protocol"`
+	Status     int       `json:"status"`
+	LatencyMS  float64   `json:"latency_ms"`
+	Bytes      int64     `json:"bytes"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent"`
+	RequestID  string    `json:"request_id"`
+}
+
+// AccessLog is a middleware which writes a line to the output for every
+// request
+type AccessLog struct {
+	w      io.Writer
+	router *mux.Router
+	config AccessLogConfig
+
+	mutex  sync.Mutex
+	random func() float64
+}
+
+// NewAccessLog creates a new AccessLog which writes to w, the router is used
+// to find the route template for each request
+func NewAccessLog(w io.Writer, router *mux.Router, config AccessLogConfig) (*AccessLog, error) {
+	switch config.Format {
+	case AccessLogNone, AccessLogCLF, AccessLogJSON, AccessLogLogfmt:
+	default:
+		return nil, fmt.Errorf(
+			"unknown access log format %s, must be one of [%s,%s,%s,%s]",
+			config.Format, AccessLogNone, AccessLogCLF, AccessLogJSON, AccessLogLogfmt,
+		)
+	}
+
+	if config.ClientIP == nil {
+		config.ClientIP = func(r *http.Request) string { return remoteHost(r.RemoteAddr) }
+	}
+
+	return &AccessLog{w: w, router: router, config: config, random: rand.Float64}, nil
+}
+
+// Middleware wraps next and logs every request which is not excluded or
+// dropped by sampling
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	if a.config.Format == AccessLogNone {
+		return next
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if a.excluded(r.URL.Path) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		st := time.Now()
+		rr := &responseRecorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(rr, r)
+
+		latency := time.Since(st)
+
+		if rr.status < http.StatusInternalServerError && !a.sampled() {
+			return
+		}
+
+		a.write(&AccessLogEntry{
+			Time:       st,
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Route:      a.route(r),
+			Protocol:   r.Proto,
+			Status:     rr.status,
+			LatencyMS:  float64(latency) / float64(time.Millisecond),
+			Bytes:      rr.bytes,
+			RemoteAddr: a.config.ClientIP(r),
+			UserAgent:  r.UserAgent(),
+			RequestID:  requestid.FromContext(r.Context()),
+		})
+	})
+}
+
+func (a *AccessLog) excluded(path string) bool {
+	for _, p := range a.config.ExcludePaths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *AccessLog) sampled() bool {
+	if a.config.SampleRate >= 1 {
+		return true
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.random() < a.config.SampleRate
+}
+
+// route returns the path template of the route which matches the request or
+// an empty string when no route matches
+func (a *AccessLog) route(r *http.Request) string {
+	if a.router == nil {
+		return ""
+	}
+
+	var m mux.RouteMatch
+	if !a.router.Match(r, &m) || m.Route == nil {
+		return ""
+	}
+
+	t, _ := m.Route.GetPathTemplate()
+	return t
+}
+
+func (a *AccessLog) write(e *AccessLogEntry) {
+	var line string
+
+	switch a.config.Format {
+	case AccessLogJSON:
+		d, _ := json.Marshal(e)
+		line = string(d)
+	case AccessLogLogfmt:
+		line = formatLogfmt(e)
+	default:
+		line = formatCLF(e)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	fmt.Fprintln(a.w, line)
+}
+
+// formatCLF formats the entry in the Common Log Format followed by the user
+// agent, request id and latency in milliseconds
+func formatCLF(e *AccessLogEntry) string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	return fmt.Sprintf(
+		`%s - - [%s] "%s %s %s" %d %s %q %s %.3f`,
+		e.RemoteAddr,
+		e.Time.Format(clfTime),
+		e.Method, e.Path, e.Protocol,
+		e.Status,
+		size,
+		e.UserAgent,
+		orDash(e.RequestID),
+		e.LatencyMS,
+	)
+}
+
+// formatLogfmt formats the entry as key=value pairs
+func formatLogfmt(e *AccessLogEntry) string {
+	pairs := [][2]string{
+		{"time", e.Time.Format(time.RFC3339)},
+		{"method", e.Method},
+		{"path", e.Path},
+		{"route", e.Route},
+		{"protocol", e.Protocol},
+		{"status", strconv.Itoa(e.Status)},
+		{"latency_ms", strconv.FormatFloat(e.LatencyMS, 'f', 3, 64)},
+		{"bytes", strconv.FormatInt(e.Bytes, 10)},
+		{"remote_addr", e.RemoteAddr},
+		{"user_agent", e.UserAgent},
+		{"request_id", e.RequestID},
+	}
+
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		v := p[1]
+		if v == "" || strings.ContainsAny(v, " =\"\\") {
+			v = strconv.Quote(v)
+		}
+
+		parts[i] = p[0] + "=" + v
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// remoteHost returns the host part of a remote address
+func remoteHost(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+
+	return addr
+}
+
+// responseRecorder records the status and number of bytes written by a
+// handler, it implements http.Flusher and http.Hijacker so streaming and
+// WebSocket handlers continue to work
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not implement http.Hijacker")
+	}
+
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
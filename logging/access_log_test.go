@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emojify-app/api/requestid"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupAccessLog(t *testing.T, config AccessLogConfig) (http.Handler, *bytes.Buffer) {
+	b := &bytes.Buffer{}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/emojify/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("hello"))
+	})
+	r.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {})
+
+	a, err := NewAccessLog(b, r, config)
+	assert.NoError(t, err)
+
+	return requestid.Middleware(a.Middleware(r)), b
+}
+
+func newAccessLogRequest(path string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("User-Agent", "test agent")
+	r.Header.Set(requestid.Header, "abc123")
+
+	return r
+}
+
+func TestAccessLogWritesCLF(t *testing.T) {
+	h, b := setupAccessLog(t, AccessLogConfig{Format: AccessLogCLF, SampleRate: 1})
+
+	h.ServeHTTP(httptest.NewRecorder(), newAccessLogRequest("/emojify/xyz"))
+
+	assert.Regexp(t, `^10\.1\.2\.3 - - \[.+\] "GET /emojify/xyz HTTP/1\.1" 200 5 "test agent" abc123 \d+\.\d{3}\n$`, b.String())
+}
+
+func TestAccessLogWritesJSON(t *testing.T) {
+	h, b := setupAccessLog(t, AccessLogConfig{Format: AccessLogJSON, SampleRate: 1})
+
+	h.ServeHTTP(httptest.NewRecorder(), newAccessLogRequest("/emojify/xyz"))
+
+	e := AccessLogEntry{}
+	assert.NoError(t, json.Unmarshal(b.Bytes(), &e))
+	assert.Equal(t, "GET", e.Method)
+	assert.Equal(t, "/emojify/{id}", e.Route)
+	assert.Equal(t, http.StatusOK, e.Status)
+	assert.Equal(t, int64(5), e.Bytes)
+	assert.Equal(t, "10.1.2.3", e.RemoteAddr)
+	assert.Equal(t, "abc123", e.RequestID)
+}
+
+func TestAccessLogWritesLogfmt(t *testing.T) {
+	h, b := setupAccessLog(t, AccessLogConfig{Format: AccessLogLogfmt, SampleRate: 1})
+
+	h.ServeHTTP(httptest.NewRecorder(), newAccessLogRequest("/emojify/xyz"))
+
+	assert.Contains(t, b.String(), `route=/emojify/{id} `)
+	assert.Contains(t, b.String(), `status=200 `)
+	assert.Contains(t, b.String(), `user_agent="test agent" `)
+	assert.Contains(t, b.String(), `request_id=abc123`)
+}
+
+func TestAccessLogSkipsExcludedPaths(t *testing.T) {
+	h, b := setupAccessLog(t, AccessLogConfig{Format: AccessLogCLF, SampleRate: 1, ExcludePaths: []string{"/health"}})
+
+	h.ServeHTTP(httptest.NewRecorder(), newAccessLogRequest("/health"))
+
+	assert.Empty(t, b.String())
+}
+
+func TestAccessLogSamplesRequestsButAlwaysLogsErrors(t *testing.T) {
+	b := &bytes.Buffer{}
+	a, _ := NewAccessLog(b, nil, AccessLogConfig{Format: AccessLogCLF, SampleRate: 0.5})
+	a.random = func() float64 { return 0.9 }
+
+	h := a.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), newAccessLogRequest("/ok"))
+	assert.Empty(t, b.String())
+
+	h.ServeHTTP(httptest.NewRecorder(), newAccessLogRequest("/fail"))
+	assert.Contains(t, b.String(), `"GET /fail HTTP/1.1" 500`)
+}
+
+func TestAccessLogUsesClientIP(t *testing.T) {
+	h, b := setupAccessLog(t, AccessLogConfig{
+		Format:     AccessLogCLF,
+		SampleRate: 1,
+		ClientIP:   func(r *http.Request) string { return r.Header.Get("X-Forwarded-For") },
+	})
+
+	r := newAccessLogRequest("/emojify/xyz")
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Regexp(t, `^203\.0\.113\.9 - - `, b.String())
+}
+
+func TestNewAccessLogReturnsErrorForUnknownFormat(t *testing.T) {
+	_, err := NewAccessLog(&bytes.Buffer{}, nil, AccessLogConfig{Format: "xml"})
+
+	assert.Error(t, err)
+}
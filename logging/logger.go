@@ -1,11 +1,14 @@
 package logging
 
 import (
+	"context"
 	"fmt"
+	"mime"
 	"net/http"
 	"time"
 
-	"github.com/DataDog/datadog-go/statsd"
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/requestid"
 	hclog "github.com/hashicorp/go-hclog"
 )
 
@@ -14,8 +17,12 @@ var statsPrefix = "service.api."
 // Logger defines an interface for common logging operations
 type Logger interface {
 	ServiceStart(address, version string)
+	ServiceStopping(signal string, drainPeriod time.Duration)
+	ServiceStopped(err error)
 
 	HealthHandlerCalled() Finished
+	HealthDependencyChecked(name string) Finished
+	HealthDependencyChanged(name string, healthy bool, err error)
 
 	ErrorInjectionHandlerError(requestCount, errorPercentage int, errorType string)
 
@@ -26,19 +33,54 @@ type Logger interface {
 
 	EmojifyHandlerPOSTCalled(r *http.Request) Finished
 	EmojifyHandlerGETCalled(r *http.Request) Finished
+	EmojifyHandlerBatchCalled(r *http.Request) Finished
+	EmojifyHandlerBatchGETCalled(r *http.Request) Finished
+	EmojifyHandlerEventsCalled(r *http.Request) Finished
+	EmojifyHandlerWebSocketCalled(r *http.Request) Finished
+	EmojifyHandlerMineCalled(r *http.Request) Finished
 	EmojifyHandlerNoPostBody()
+	EmojifyHandlerInvalidBody(contentType string, err error)
+	EmojifyHandlerUploadImage(id string, size int) Finished
 	EmojifyHandlerInvalidURL(uri string, err error)
+	EmojifyHandlerURLRejected(uri string, err error)
 	EmojifyHandlerCallCreate(uri string) Finished
+	EmojifyHandlerIdempotentReplay(key string)
+	EmojifyHandlerIdempotencyRejected(key string, status int)
+	EmojifyHandlerQuotaExceeded(subject, period string)
+	EmojifyHandlerQuotaConsumeFailed(subject string, err error)
 	EmojifyHandlerCallQuery(id string) Finished
 
+	JobAccessDenied(id string)
+
+	UpstreamRetry(upstream, method string, attempt int, err error)
+	UpstreamRetryBudgetExhausted(upstream, method string)
+
+	CircuitBreakerStateChanged(name, from, to string)
+	CircuitBreakerRejected(name string)
+
+	RateLimitRejected(group, key string)
+
+	AuthenticationFailed(group, reason string, err error)
+
+	PaymentHandlerCalled(r *http.Request) Finished
+	PaymentHandlerInvalidRequest(err error)
+	PaymentHandlerCallGateway(uri string) Finished
+
 	Log() hclog.Logger
+
+	// WithContext returns a Logger which adds the request id and the
+	// authenticated subject carried by ctx to every log line
+	WithContext(ctx context.Context) Logger
+
+	// Close flushes any buffered metrics and releases the metrics client
+	Close() error
 }
 
 // Finished defines a function to be returned by logging methods which contain timers
 type Finished func(status int, err error)
 
-// New creates a new logger with the given name and points it at a statsd server
-func New(name, version, statsDServer, logLevel string, logFormat string) (Logger, error) {
+// New creates a new logger with the given name which emits metrics to the sink
+func New(name string, sink MetricsSink, logLevel string, logFormat string) Logger {
 	o := &hclog.LoggerOptions{}
 	o.Name = name
 
@@ -50,20 +92,13 @@ func New(name, version, statsDServer, logLevel string, logFormat string) (Logger
 	o.Level = hclog.LevelFromString(logLevel)
 	l := hclog.New(o)
 
-	c, err := statsd.New(statsDServer)
-	c.Tags = []string{fmt.Sprintf("version:%s", version)}
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &LoggerImpl{l, c}, nil
+	return &LoggerImpl{l, sink}
 }
 
 // LoggerImpl is a concrete implementation for the logger function
 type LoggerImpl struct {
 	l hclog.Logger
-	s *statsd.Client
+	s MetricsSink
 }
 
 // Log returns the underlying logger
@@ -71,12 +106,90 @@ func (l *LoggerImpl) Log() hclog.Logger {
 	return l.l
 }
 
+// WithContext returns a Logger which adds the request id and authenticated
+// subject carried by ctx to every log line, returns the logger unchanged when
+// ctx has neither
+func (l *LoggerImpl) WithContext(ctx context.Context) Logger {
+	var args []interface{}
+	if id := requestid.FromContext(ctx); id != "" {
+		args = append(args, "request_id", id)
+	}
+
+	if sub := auth.SubjectFromContext(ctx); sub != "" {
+		args = append(args, "subject", sub)
+	}
+
+	if len(args) == 0 {
+		return l
+	}
+
+	return &LoggerImpl{l.l.With(args...), l.s}
+}
+
 // ServiceStart logs information about the service start
 func (l *LoggerImpl) ServiceStart(address, version string) {
 	l.s.Incr(statsPrefix+"started", nil, 1)
 	l.l.Info("Service started", "address", address, "version", version)
 }
 
+// ServiceStopping logs information when the service receives a signal to shut down
+func (l *LoggerImpl) ServiceStopping(signal string, drainPeriod time.Duration) {
+	l.s.Incr(statsPrefix+"stopping", nil, 1)
+	l.l.Info("Service stopping, draining connections", "signal", signal, "drain_period", drainPeriod)
+}
+
+// ServiceStopped logs information when the service has finished shutting down
+func (l *LoggerImpl) ServiceStopped(err error) {
+	if err != nil {
+		l.l.Error("Service stopped with error", "error", err)
+		return
+	}
+
+	l.l.Info("Service stopped")
+}
+
+// Close flushes any buffered metrics to the sink and closes it
+func (l *LoggerImpl) Close() error {
+	if err := l.s.Flush(); err != nil {
+		return err
+	}
+
+	return l.s.Close()
+}
+
+// HealthDependencyChecked logs information when a dependency is probed by the
+// background health checks, the returned function must be called once the
+// check has completed
+func (l *LoggerImpl) HealthDependencyChecked(name string) Finished {
+	st := time.Now()
+	l.l.Trace("Checking dependency health", "dependency", name)
+
+	return func(status int, err error) {
+		tags := append(getStatusTags(status), fmt.Sprintf("dependency:%s", name))
+		l.s.Timing(statsPrefix+"health.dependency", time.Now().Sub(st), tags, 1)
+
+		if err != nil {
+			l.l.Debug("Dependency health check failed", "dependency", name, "error", err)
+			return
+		}
+
+		l.l.Trace("Dependency health check finished", "dependency", name)
+	}
+}
+
+// HealthDependencyChanged logs information when a dependency changes between
+// healthy and unhealthy
+func (l *LoggerImpl) HealthDependencyChanged(name string, healthy bool, err error) {
+	l.s.Incr(statsPrefix+"health.dependency_changed", []string{fmt.Sprintf("dependency:%s", name), fmt.Sprintf("healthy:%t", healthy)}, 1)
+
+	if !healthy {
+		l.l.Warn("Dependency is unhealthy", "dependency", name, "error", err)
+		return
+	}
+
+	l.l.Info("Dependency is healthy", "dependency", name)
+}
+
 // HealthHandlerCalled logs information when the health handler is called, the returned function
 // must be called once work has completed
 func (l *LoggerImpl) HealthHandlerCalled() Finished {
@@ -176,18 +289,126 @@ func (l *LoggerImpl) EmojifyHandlerGETCalled(r *http.Request) Finished {
 	}
 }
 
+// EmojifyHandlerBatchCalled logs information when the Emojify batch handler is called
+func (l *LoggerImpl) EmojifyHandlerBatchCalled(r *http.Request) Finished {
+	st := time.Now()
+	l.l.Debug("Emojify batch called", "method", r.Method, "URI", r.URL.String())
+
+	return func(status int, err error) {
+		l.s.Timing(statsPrefix+"emojify.batch.called", time.Now().Sub(st), getStatusTags(status), 1)
+		if err != nil {
+			l.l.Error("Emojify batch handler finished with error", "status", status, "err", err)
+			return
+		}
+		l.l.Debug("Emojify batch handler finished", "status", status)
+	}
+}
+
+// EmojifyHandlerBatchGETCalled logs information when the Emojify batch query handler is called
+func (l *LoggerImpl) EmojifyHandlerBatchGETCalled(r *http.Request) Finished {
+	st := time.Now()
+	l.l.Debug("Emojify batch GET called", "method", r.Method, "URI", r.URL.String())
+
+	return func(status int, err error) {
+		l.s.Timing(statsPrefix+"emojify.batch.get.called", time.Now().Sub(st), getStatusTags(status), 1)
+		if err != nil {
+			l.l.Error("Emojify batch GET handler finished with error", "status", status, "err", err)
+			return
+		}
+		l.l.Debug("Emojify batch GET handler finished", "status", status)
+	}
+}
+
+// EmojifyHandlerEventsCalled logs information when the Emojify events handler is called
+func (l *LoggerImpl) EmojifyHandlerEventsCalled(r *http.Request) Finished {
+	st := time.Now()
+	l.l.Debug("Emojify events called", "method", r.Method, "URI", r.URL.String())
+	l.s.Incr(statsPrefix+"emojify.events.started", nil, 1)
+
+	return func(status int, err error) {
+		l.s.Timing(statsPrefix+"emojify.events.called", time.Now().Sub(st), getStatusTags(status), 1)
+		if err != nil {
+			l.l.Error("Emojify events handler finished with error", "status", status, "err", err)
+			return
+		}
+		l.l.Debug("Emojify events handler finished", "status", status)
+	}
+}
+
+// EmojifyHandlerWebSocketCalled logs information when a WebSocket connection is opened,
+// the returned function must be called when the connection closes
+func (l *LoggerImpl) EmojifyHandlerWebSocketCalled(r *http.Request) Finished {
+	st := time.Now()
+	l.l.Debug("Emojify WebSocket opened", "method", r.Method, "URI", r.URL.String())
+	l.s.Incr(statsPrefix+"emojify.websocket.opened", nil, 1)
+
+	return func(status int, err error) {
+		l.s.Timing(statsPrefix+"emojify.websocket.called", time.Now().Sub(st), getStatusTags(status), 1)
+		if err != nil {
+			l.l.Error("Emojify WebSocket closed with error", "status", status, "err", err)
+			return
+		}
+		l.l.Debug("Emojify WebSocket closed", "status", status)
+	}
+}
+
+// EmojifyHandlerMineCalled logs information when the handler listing the jobs
+// of the client is called, the returned function must be called once work has
+// completed
+func (l *LoggerImpl) EmojifyHandlerMineCalled(r *http.Request) Finished {
+	st := time.Now()
+	l.l.Debug("Emojify mine called", "method", r.Method, "URI", r.URL.String())
+
+	return func(status int, err error) {
+		l.s.Timing(statsPrefix+"emojify.mine.called", time.Now().Sub(st), getStatusTags(status), 1)
+		if err != nil {
+			l.l.Error("Emojify mine handler finished with error", "status", status, "err", err)
+			return
+		}
+		l.l.Debug("Emojify mine handler finished", "status", status)
+	}
+}
+
 // EmojifyHandlerNoPostBody logs information when no post body is sent with the request
 func (l *LoggerImpl) EmojifyHandlerNoPostBody() {
 	l.l.Error("No body for POST", "handler", "emojify")
 	l.s.Incr(statsPrefix+"emojify.no_post_body", nil, 1)
 }
 
+// EmojifyHandlerInvalidBody logs information when the POST body can not be parsed
+func (l *LoggerImpl) EmojifyHandlerInvalidBody(contentType string, err error) {
+	l.l.Error("Unable to parse POST body", "handler", "emojify", "content-type", contentType, "error", err)
+	l.s.Incr(statsPrefix+"emojify.invalid_body", []string{"content_type:" + contentTypeTag(contentType)}, 1)
+}
+
+// EmojifyHandlerUploadImage logs information when an uploaded image is stored in the cache
+func (l *LoggerImpl) EmojifyHandlerUploadImage(id string, size int) Finished {
+	st := time.Now()
+	l.l.Debug("Storing uploaded image", "handler", "emojify", "id", id, "size", size)
+
+	return func(status int, err error) {
+		l.s.Timing(statsPrefix+"emojify.upload", time.Now().Sub(st), getStatusTags(status), 1)
+		if err != nil {
+			l.l.Error("Unable to store uploaded image", "handler", "emojify", "id", id, "error", err)
+			return
+		}
+
+		l.l.Debug("Stored uploaded image", "handler", "emojify", "id", id, "status", status)
+	}
+}
+
 // EmojifyHandlerInvalidURL logs information when an invalid URI is passed in the body
 func (l *LoggerImpl) EmojifyHandlerInvalidURL(uri string, err error) {
 	l.l.Error("Unable to validate URI", "handler", "emojify", "uri", uri, "error", err)
 	l.s.Incr(statsPrefix+"emojify.invalid_uri", nil, 1)
 }
 
+// EmojifyHandlerURLRejected logs information when a URI is rejected by the URL policy
+func (l *LoggerImpl) EmojifyHandlerURLRejected(uri string, err error) {
+	l.l.Warn("URI rejected by policy", "handler", "emojify", "uri", uri, "error", err)
+	l.s.Incr(statsPrefix+"emojify.url_rejected", nil, 1)
+}
+
 // EmojifyHandlerCallCreate logs information when the Emojify upstream create method is called
 func (l *LoggerImpl) EmojifyHandlerCallCreate(uri string) Finished {
 	st := time.Now()
@@ -199,6 +420,35 @@ func (l *LoggerImpl) EmojifyHandlerCallCreate(uri string) Finished {
 	}
 }
 
+// EmojifyHandlerIdempotentReplay logs information when the stored response
+// for an idempotency key is returned rather than creating a new job
+func (l *LoggerImpl) EmojifyHandlerIdempotentReplay(key string) {
+	l.s.Incr(statsPrefix+"emojify.idempotent_replay", nil, 1)
+	l.l.Debug("Replaying response for idempotency key", "key", key)
+}
+
+// EmojifyHandlerIdempotencyRejected logs information when a request is
+// rejected because its idempotency key is in use or was used for a different
+// image
+func (l *LoggerImpl) EmojifyHandlerIdempotencyRejected(key string, status int) {
+	l.s.Incr(statsPrefix+"emojify.idempotency_rejected", getStatusTags(status), 1)
+	l.l.Debug("Request rejected for idempotency key", "key", key, "status", status)
+}
+
+// EmojifyHandlerQuotaExceeded logs information when a job is not created
+// because the client has exceeded its daily or monthly quota
+func (l *LoggerImpl) EmojifyHandlerQuotaExceeded(subject, period string) {
+	l.s.Incr(statsPrefix+"emojify.quota_exceeded", []string{fmt.Sprintf("period:%s", period)}, 1)
+	l.l.Debug("Job quota exceeded", "subject", subject, "period", period)
+}
+
+// EmojifyHandlerQuotaConsumeFailed logs an error when a created job could not
+// be recorded against the quota of the client
+func (l *LoggerImpl) EmojifyHandlerQuotaConsumeFailed(subject string, err error) {
+	l.s.Incr(statsPrefix+"emojify.quota_error", nil, 1)
+	l.l.Error("Unable to record job against quota", "subject", subject, "error", err)
+}
+
 // EmojifyHandlerCallQuery logs information when the Emojify upstream query method is called
 func (l *LoggerImpl) EmojifyHandlerCallQuery(id string) Finished {
 	st := time.Now()
@@ -210,6 +460,124 @@ func (l *LoggerImpl) EmojifyHandlerCallQuery(id string) Finished {
 	}
 }
 
+// UpstreamRetry logs information when a failed call to an upstream is retried,
+// attempt is the number of the retry starting at 1
+func (l *LoggerImpl) UpstreamRetry(upstream, method string, attempt int, err error) {
+	l.s.Incr(statsPrefix+"upstream.retry", []string{fmt.Sprintf("upstream:%s", upstream), fmt.Sprintf("method:%s", method)}, 1)
+	l.l.Debug("Retrying upstream call", "upstream", upstream, "method", method, "attempt", attempt, "error", err)
+}
+
+// UpstreamRetryBudgetExhausted logs information when a failed call is not
+// retried because the retry budget for the upstream has been spent
+func (l *LoggerImpl) UpstreamRetryBudgetExhausted(upstream, method string) {
+	l.s.Incr(statsPrefix+"upstream.retry_budget_exhausted", []string{fmt.Sprintf("upstream:%s", upstream), fmt.Sprintf("method:%s", method)}, 1)
+	l.l.Warn("Retry budget exhausted", "upstream", upstream, "method", method)
+}
+
+// JobAccessDenied logs information when a client requests a job or image
+// owned by another client
+func (l *LoggerImpl) JobAccessDenied(id string) {
+	l.s.Incr(statsPrefix+"job.access_denied", nil, 1)
+	l.l.Debug("Access to job denied", "ID", id)
+}
+
+// CircuitBreakerStateChanged logs information when the circuit breaker for an
+// upstream changes state
+func (l *LoggerImpl) CircuitBreakerStateChanged(name, from, to string) {
+	l.s.Incr(statsPrefix+"circuit_breaker.state_changed", []string{fmt.Sprintf("upstream:%s", name), fmt.Sprintf("state:%s", to)}, 1)
+
+	if to == "open" {
+		l.l.Warn("Circuit breaker opened", "upstream", name, "from", from)
+		return
+	}
+
+	l.l.Info("Circuit breaker state changed", "upstream", name, "from", from, "to", to)
+}
+
+// CircuitBreakerRejected logs information when a call to an upstream is
+// rejected because the circuit breaker is open
+func (l *LoggerImpl) CircuitBreakerRejected(name string) {
+	l.s.Incr(statsPrefix+"circuit_breaker.rejected", []string{fmt.Sprintf("upstream:%s", name)}, 1)
+	l.l.Debug("Circuit breaker rejected call", "upstream", name)
+}
+
+// RateLimitRejected logs information when a request is rejected because the
+// client has exceeded the rate limit for the route group
+func (l *LoggerImpl) RateLimitRejected(group, key string) {
+	l.s.Incr(statsPrefix+"ratelimit.rejected", []string{fmt.Sprintf("group:%s", group)}, 1)
+	l.l.Debug("Request rejected by rate limit", "group", group, "client", key)
+}
+
+// AuthenticationFailed logs information when a request to a route group is
+// rejected because the credentials are missing or invalid
+func (l *LoggerImpl) AuthenticationFailed(group, reason string, err error) {
+	l.s.Incr(statsPrefix+"auth.failed", []string{fmt.Sprintf("group:%s", group), fmt.Sprintf("reason:%s", reason)}, 1)
+	l.l.Debug("Authentication failed", "group", group, "reason", reason, "error", err)
+}
+
+// PaymentHandlerCalled logs information when the Payment handler is called
+func (l *LoggerImpl) PaymentHandlerCalled(r *http.Request) Finished {
+	st := time.Now()
+	l.l.Debug("Payment called", "method", r.Method, "URI", r.URL.String())
+
+	return func(status int, err error) {
+		l.s.Timing(statsPrefix+"payment.called", time.Now().Sub(st), getStatusTags(status), 1)
+		if err != nil {
+			l.l.Error("Payment handler finished with error", "status", status, "err", err)
+			return
+		}
+
+		l.l.Debug("Payment handler finished", "status", status)
+	}
+}
+
+// PaymentHandlerInvalidRequest logs information when the payment request fails validation
+func (l *LoggerImpl) PaymentHandlerInvalidRequest(err error) {
+	l.l.Debug("Invalid payment request", "handler", "payment", "error", err)
+	l.s.Incr(statsPrefix+"payment.invalid_request", nil, 1)
+}
+
+// PaymentHandlerCallGateway logs information when the upstream payment gateway is called
+func (l *LoggerImpl) PaymentHandlerCallGateway(uri string) Finished {
+	st := time.Now()
+	l.l.Debug("Payment gateway called", "upstream", uri)
+
+	return func(status int, err error) {
+		l.s.Timing(statsPrefix+"payment.gateway.called", time.Now().Sub(st), getStatusTags(status), 1)
+		if err != nil {
+			l.l.Error("Payment gateway returned an error", "upstream", uri, "status", status, "error", err)
+			return
+		}
+
+		l.l.Debug("Payment gateway finished", "upstream", uri, "status", status)
+	}
+}
+
+// contentTypeTags are the media types which are tagged on metrics, any other
+// content type is tagged as other so the client can not create new series
+var contentTypeTags = map[string]bool{
+	"application/json":    true,
+	"multipart/form-data": true,
+	"image/png":           true,
+	"image/jpeg":          true,
+	"text/plain":          true,
+}
+
+// contentTypeTag returns the media type of a Content-Type header for a metric
+// tag, parameters such as the multipart boundary are removed
+func contentTypeTag(contentType string) string {
+	if contentType == "" {
+		return "none"
+	}
+
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !contentTypeTags[mt] {
+		return "other"
+	}
+
+	return mt
+}
+
 func getStatusTags(status int) []string {
 	return []string{
 		fmt.Sprintf("status:%d", status),
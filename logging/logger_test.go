@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/requestid"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupLogger() (*LoggerImpl, *bytes.Buffer) {
+	b := &bytes.Buffer{}
+	l := hclog.New(&hclog.LoggerOptions{Output: b, Level: hclog.Debug})
+
+	return &LoggerImpl{l, NewNoopSink()}, b
+}
+
+func TestWithContextAddsRequestIDToLogLines(t *testing.T) {
+	l, b := setupLogger()
+	ctx := requestid.NewContext(context.Background(), "abc123")
+
+	l.WithContext(ctx).EmojifyHandlerNoPostBody()
+
+	assert.Contains(t, b.String(), "request_id=abc123")
+}
+
+func TestWithContextWithoutRequestIDReturnsLogger(t *testing.T) {
+	l, _ := setupLogger()
+
+	assert.Equal(t, l, l.WithContext(context.Background()))
+}
+
+func TestWithContextAddsSubjectToLogLines(t *testing.T) {
+	l, b := setupLogger()
+	ctx := auth.NewContext(context.Background(), &auth.Identity{Subject: "nic"})
+
+	l.WithContext(ctx).EmojifyHandlerNoPostBody()
+
+	assert.Contains(t, b.String(), "subject=nic")
+}
+
+func TestInvalidBodyTagsMediaTypeFromAllowlist(t *testing.T) {
+	m := NewInMemorySink()
+	l := &LoggerImpl{hclog.NewNullLogger(), m}
+
+	l.EmojifyHandlerInvalidBody("multipart/form-data; boundary=abc123", nil)
+	l.EmojifyHandlerInvalidBody("application/x-made-up", nil)
+	l.EmojifyHandlerInvalidBody("", nil)
+
+	mts := m.Metrics()
+	assert.Equal(t, []string{"content_type:multipart/form-data"}, mts[0].Tags)
+	assert.Equal(t, []string{"content_type:other"}, mts[1].Tags)
+	assert.Equal(t, []string{"content_type:none"}, mts[2].Tags)
+}
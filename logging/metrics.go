@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// Metrics backends which can be passed to NewMetricsSink
+const (
+	MetricsStatsD     = "statsd"
+	MetricsPrometheus = "prometheus"
+	MetricsBoth       = "both"
+)
+
+// MetricsSink defines a backend for the metrics emitted by the Logger, the
+// method signatures match the statsd client so *statsd.Client is a valid
+// MetricsSink
+type MetricsSink interface {
+	Incr(name string, tags []string, rate float64) error
+	Timing(name string, value time.Duration, tags []string, rate float64) error
+	Gauge(name string, value float64, tags []string, rate float64) error
+	Histogram(name string, value float64, tags []string, rate float64) error
+
+	// Flush sends any buffered metrics to the backend
+	Flush() error
+	// Close releases any resources held by the sink
+	Close() error
+}
+
+// NewStatsDSink creates a MetricsSink which emits metrics to a statsd server,
+// every metric is tagged with the version
+func NewStatsDSink(statsDServer, version string) (MetricsSink, error) {
+	c, err := statsd.New(statsDServer)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Tags = []string{fmt.Sprintf("version:%s", version)}
+
+	return c, nil
+}
+
+// NewMetricsSink creates the MetricsSink for the given backend
+// [statsd,prometheus,both], the returned handler serves the Prometheus metrics
+// and is nil when Prometheus is not enabled
+func NewMetricsSink(backend, version, statsDServer string) (MetricsSink, http.Handler, error) {
+	switch backend {
+	case MetricsStatsD:
+		s, err := NewStatsDSink(statsDServer, version)
+		return s, nil, err
+
+	case MetricsPrometheus:
+		p := NewPrometheusSink(version)
+		return p, p, nil
+
+	case MetricsBoth:
+		s, err := NewStatsDSink(statsDServer, version)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		p := NewPrometheusSink(version)
+		return MultiSink{s, p}, p, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown metrics backend %s, must be one of [%s,%s,%s]", backend, MetricsStatsD, MetricsPrometheus, MetricsBoth)
+}
+
+// MultiSink emits metrics to multiple sinks
+type MultiSink []MetricsSink
+
+// Incr increments a counter in every sink
+func (m MultiSink) Incr(name string, tags []string, rate float64) error {
+	return m.each(func(s MetricsSink) error { return s.Incr(name, tags, rate) })
+}
+
+// Timing records a timer in every sink
+func (m MultiSink) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return m.each(func(s MetricsSink) error { return s.Timing(name, value, tags, rate) })
+}
+
+// Gauge records a gauge in every sink
+func (m MultiSink) Gauge(name string, value float64, tags []string, rate float64) error {
+	return m.each(func(s MetricsSink) error { return s.Gauge(name, value, tags, rate) })
+}
+
+// Histogram records a histogram value in every sink
+func (m MultiSink) Histogram(name string, value float64, tags []string, rate float64) error {
+	return m.each(func(s MetricsSink) error { return s.Histogram(name, value, tags, rate) })
+}
+
+// Flush flushes every sink
+func (m MultiSink) Flush() error {
+	return m.each(func(s MetricsSink) error { return s.Flush() })
+}
+
+// Close closes every sink
+func (m MultiSink) Close() error {
+	return m.each(func(s MetricsSink) error { return s.Close() })
+}
+
+// each calls f for every sink returning the first error
+func (m MultiSink) each(f func(s MetricsSink) error) error {
+	var err error
+	for _, s := range m {
+		if e := f(s); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
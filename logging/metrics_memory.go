@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"sync"
+	"time"
+)
+
+// Metric types recorded by the InMemorySink
+const (
+	MetricCounter   = "counter"
+	MetricTiming    = "timing"
+	MetricGauge     = "gauge"
+	MetricHistogram = "histogram"
+)
+
+// Metric is a single metric recorded by the InMemorySink, Value is the
+// duration in seconds for timings and 1 for counters
+type Metric struct {
+	Type  string
+	Name  string
+	Value float64
+	Tags  []string
+}
+
+// InMemorySink is a MetricsSink which records metrics in memory so that
+// tests can assert on the metrics emitted
+type InMemorySink struct {
+	mutex   sync.Mutex
+	metrics []Metric
+}
+
+// NewInMemorySink creates a new InMemorySink
+func NewInMemorySink() *InMemorySink {
+	return &InMemorySink{}
+}
+
+// Incr records a counter
+func (m *InMemorySink) Incr(name string, tags []string, rate float64) error {
+	m.record(MetricCounter, name, 1, tags)
+	return nil
+}
+
+// Timing records a timing
+func (m *InMemorySink) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	m.record(MetricTiming, name, value.Seconds(), tags)
+	return nil
+}
+
+// Gauge records a gauge
+func (m *InMemorySink) Gauge(name string, value float64, tags []string, rate float64) error {
+	m.record(MetricGauge, name, value, tags)
+	return nil
+}
+
+// Histogram records a histogram value
+func (m *InMemorySink) Histogram(name string, value float64, tags []string, rate float64) error {
+	m.record(MetricHistogram, name, value, tags)
+	return nil
+}
+
+// Flush is a no-op
+func (m *InMemorySink) Flush() error {
+	return nil
+}
+
+// Close is a no-op
+func (m *InMemorySink) Close() error {
+	return nil
+}
+
+// Metrics returns all metrics recorded by the sink in the order they were
+// emitted
+func (m *InMemorySink) Metrics() []Metric {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	out := make([]Metric, len(m.metrics))
+	copy(out, m.metrics)
+
+	return out
+}
+
+// Count returns the number of times a metric with the given name has been
+// emitted
+func (m *InMemorySink) Count(name string) int {
+	c := 0
+	for _, mt := range m.Metrics() {
+		if mt.Name == name {
+			c++
+		}
+	}
+
+	return c
+}
+
+// Reset removes all recorded metrics
+func (m *InMemorySink) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.metrics = nil
+}
+
+func (m *InMemorySink) record(t, name string, value float64, tags []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.metrics = append(m.metrics, Metric{t, name, value, tags})
+}
+
+// NoopSink is a MetricsSink which discards all metrics
+type NoopSink struct{}
+
+// NewNoopSink creates a new NoopSink
+func NewNoopSink() NoopSink {
+	return NoopSink{}
+}
+
+// Incr does nothing
+func (NoopSink) Incr(name string, tags []string, rate float64) error { return nil }
+
+// Timing does nothing
+func (NoopSink) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return nil
+}
+
+// Gauge does nothing
+func (NoopSink) Gauge(name string, value float64, tags []string, rate float64) error { return nil }
+
+// Histogram does nothing
+func (NoopSink) Histogram(name string, value float64, tags []string, rate float64) error {
+	return nil
+}
+
+// Flush does nothing
+func (NoopSink) Flush() error { return nil }
+
+// Close does nothing
+func (NoopSink) Close() error { return nil }
@@ -0,0 +1,207 @@
+package logging
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusSink is a MetricsSink which converts statsd style metrics into
+// Prometheus collectors, tags in the form key:value become labels. The sink
+// is a http.Handler which serves the metrics for scraping.
+//
+// Collectors are created the first time a metric is emitted, the label names
+// are taken from the tags of the first call, later calls with different tags
+// have missing labels set to an empty string and unknown labels dropped.
+type PrometheusSink struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+	version  string
+
+	mutex      sync.Mutex
+	collectors map[string]prometheus.Collector
+	labels     map[string][]string
+}
+
+// NewPrometheusSink creates a new PrometheusSink, every metric is labeled
+// with the version
+func NewPrometheusSink(version string) *PrometheusSink {
+	r := prometheus.NewRegistry()
+	r.MustRegister(prometheus.NewGoCollector())
+	r.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	return &PrometheusSink{
+		registry:   r,
+		handler:    promhttp.HandlerFor(r, promhttp.HandlerOpts{}),
+		version:    version,
+		collectors: map[string]prometheus.Collector{},
+		labels:     map[string][]string{},
+	}
+}
+
+// ServeHTTP serves the metrics in the Prometheus exposition format
+func (p *PrometheusSink) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(rw, r)
+}
+
+// Incr increments a counter with the suffix _total
+func (p *PrometheusSink) Incr(name string, tags []string, rate float64) error {
+	c, lv, err := p.collector(prometheusName(name)+"_total", tags, func(opts prometheus.Opts, labels []string) prometheus.Collector {
+		return prometheus.NewCounterVec(prometheus.CounterOpts(opts), labels)
+	})
+	if err != nil {
+		return err
+	}
+
+	cv, ok := c.(*prometheus.CounterVec)
+	if !ok {
+		return errMetricType(name)
+	}
+
+	cv.WithLabelValues(lv...).Inc()
+	return nil
+}
+
+// Timing records a duration in a histogram with the suffix _seconds
+func (p *PrometheusSink) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return p.observe(prometheusName(name)+"_seconds", value.Seconds(), tags)
+}
+
+// Gauge sets a gauge
+func (p *PrometheusSink) Gauge(name string, value float64, tags []string, rate float64) error {
+	c, lv, err := p.collector(prometheusName(name), tags, func(opts prometheus.Opts, labels []string) prometheus.Collector {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts(opts), labels)
+	})
+	if err != nil {
+		return err
+	}
+
+	gv, ok := c.(*prometheus.GaugeVec)
+	if !ok {
+		return errMetricType(name)
+	}
+
+	gv.WithLabelValues(lv...).Set(value)
+	return nil
+}
+
+// Histogram records a value in a histogram
+func (p *PrometheusSink) Histogram(name string, value float64, tags []string, rate float64) error {
+	return p.observe(prometheusName(name), value, tags)
+}
+
+// Flush is a no-op, metrics are collected when Prometheus scrapes the handler
+func (p *PrometheusSink) Flush() error {
+	return nil
+}
+
+// Close is a no-op
+func (p *PrometheusSink) Close() error {
+	return nil
+}
+
+func (p *PrometheusSink) observe(name string, value float64, tags []string) error {
+	c, lv, err := p.collector(name, tags, func(opts prometheus.Opts, labels []string) prometheus.Collector {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        opts.Name,
+			Help:        opts.Help,
+			ConstLabels: opts.ConstLabels,
+		}, labels)
+	})
+	if err != nil {
+		return err
+	}
+
+	hv, ok := c.(*prometheus.HistogramVec)
+	if !ok {
+		return errMetricType(name)
+	}
+
+	hv.WithLabelValues(lv...).Observe(value)
+	return nil
+}
+
+// collector returns the collector for the metric name and the label values for
+// the tags, the collector is created and registered with create if it does not
+// exist
+func (p *PrometheusSink) collector(
+	name string,
+	tags []string,
+	create func(opts prometheus.Opts, labels []string) prometheus.Collector,
+) (prometheus.Collector, []string, error) {
+	values := parseTags(tags)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	c, ok := p.collectors[name]
+	if !ok {
+		p.labels[name] = labelNames(values)
+		c = create(prometheus.Opts{
+			Name:        name,
+			Help:        name,
+			ConstLabels: prometheus.Labels{"version": p.version},
+		}, p.labels[name])
+
+		if err := p.registry.Register(c); err != nil {
+			return nil, nil, err
+		}
+
+		p.collectors[name] = c
+	}
+
+	return c, labelValues(p.labels[name], values), nil
+}
+
+func errMetricType(name string) error {
+	return fmt.Errorf("metric %s is already registered with a different type", name)
+}
+
+// prometheusName converts a statsd metric name into a valid Prometheus name
+func prometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, name)
+}
+
+// parseTags converts statsd tags in the form key:value into a map
+func parseTags(tags []string) map[string]string {
+	values := map[string]string{}
+	for _, t := range tags {
+		parts := strings.SplitN(t, ":", 2)
+		if len(parts) == 2 {
+			values[prometheusName(parts[0])] = parts[1]
+		}
+	}
+
+	return values
+}
+
+func labelNames(values map[string]string) []string {
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func labelValues(names []string, values map[string]string) []string {
+	lv := make([]string, len(names))
+	for i, n := range names {
+		lv[i] = values[n]
+	}
+
+	return lv
+}
@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(p *PrometheusSink) string {
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+
+	b, _ := ioutil.ReadAll(rw.Body)
+	return string(b)
+}
+
+func TestPrometheusConvertsCountersAndTimers(t *testing.T) {
+	p := NewPrometheusSink("test")
+
+	p.Incr("service.api.error.injected", []string{"type:delay"}, 1)
+	p.Timing("service.api.cache.get", 10*time.Millisecond, []string{"status:200"}, 1)
+
+	out := scrape(p)
+	assert.Contains(t, out, `service_api_error_injected_total{type="delay",version="test"} 1`)
+	assert.Contains(t, out, `service_api_cache_get_seconds_count{status="200",version="test"} 1`)
+}
+
+func TestPrometheusHandlesInconsistentTags(t *testing.T) {
+	p := NewPrometheusSink("test")
+
+	assert.NoError(t, p.Incr("service.api.thing", []string{"status:200"}, 1))
+	assert.NoError(t, p.Incr("service.api.thing", []string{"other:abc"}, 1))
+
+	assert.Contains(t, scrape(p), `service_api_thing_total{status="",version="test"} 1`)
+}
+
+func TestPrometheusReturnsErrorForTypeMismatch(t *testing.T) {
+	p := NewPrometheusSink("test")
+
+	assert.NoError(t, p.Gauge("service.api.thing_seconds", 1, nil, 1))
+	assert.Error(t, p.Timing("service.api.thing", time.Second, nil, 1))
+}
+
+func TestNewMetricsSinkReturnsErrorForUnknownBackend(t *testing.T) {
+	_, _, err := NewMetricsSink("influx", "test", "localhost:8125")
+
+	assert.Error(t, err)
+}
+
+func TestNewMetricsSinkReturnsHandlerForPrometheus(t *testing.T) {
+	_, h, err := NewMetricsSink(MetricsPrometheus, "test", "localhost:8125")
+
+	assert.NoError(t, err)
+	assert.NotNil(t, h)
+}
+
+func TestInMemorySinkRecordsMetrics(t *testing.T) {
+	m := NewInMemorySink()
+	l := New("test", m, "error", "text")
+
+	l.CacheHandlerCalled(httptest.NewRequest("GET", "/cache/abc", nil))(200, nil)
+
+	assert.Equal(t, 1, m.Count("service.api.cache.called"))
+	assert.Equal(t, MetricTiming, m.Metrics()[0].Type)
+	assert.Contains(t, m.Metrics()[0].Tags, "status:200")
+}
+
+func TestMultiSinkEmitsToEverySink(t *testing.T) {
+	a := NewInMemorySink()
+	b := NewInMemorySink()
+
+	MultiSink{a, b}.Incr("service.api.thing", nil, 1)
+
+	assert.Equal(t, 1, a.Count("service.api.thing"))
+	assert.Equal(t, 1, b.Count("service.api.thing"))
+}
@@ -0,0 +1,90 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Header is the HTTP header and gRPC metadata key which carries the request id
+const Header = "X-Request-Id"
+
+// maxLength is the maximum length of a request id accepted from a client,
+// longer ids are replaced
+const maxLength = 128
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx which carries the request id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request id carried by ctx or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// New generates a random request id
+func New() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Middleware assigns a request id to every request, the id sent by the client
+// in the X-Request-Id header is used when it is valid otherwise a new id is
+// generated. The id is added to the request context and returned to the
+// client in the X-Request-Id response header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = New()
+		}
+
+		r.Header.Set(Header, id)
+		rw.Header().Set(Header, id)
+
+		next.ServeHTTP(rw, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// UnaryClientInterceptor returns a gRPC interceptor which adds the request id
+// from the context to the outgoing metadata
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if id := FromContext(ctx); id != "" {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			md = md.Copy()
+			md.Set(Header, id)
+			ctx = metadata.NewOutgoingContext(ctx, md)
+		}
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// valid returns true when the id is safe to echo in headers and logs
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,79 @@
+package requestid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func serve(r *http.Request) (*httptest.ResponseRecorder, string) {
+	var id string
+	h := Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id = FromContext(r.Context())
+	}))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+
+	return rw, id
+}
+
+func TestMiddlewareGeneratesIDWhenMissing(t *testing.T) {
+	rw, id := serve(httptest.NewRequest("GET", "/", nil))
+
+	assert.Len(t, id, 32)
+	assert.Equal(t, id, rw.Header().Get(Header))
+}
+
+func TestMiddlewarePropagatesClientID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(Header, "abc-123")
+
+	rw, id := serve(r)
+
+	assert.Equal(t, "abc-123", id)
+	assert.Equal(t, "abc-123", rw.Header().Get(Header))
+}
+
+func TestMiddlewareReplacesInvalidClientID(t *testing.T) {
+	for _, bad := range []string{"abc 123", "abc\"123", strings.Repeat("a", maxLength+1)} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(Header, bad)
+
+		_, id := serve(r)
+
+		assert.NotEqual(t, bad, id)
+		assert.Len(t, id, 32)
+	}
+}
+
+func TestInterceptorAddsIDToMetadata(t *testing.T) {
+	var md metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+
+	ctx := NewContext(context.Background(), "abc123")
+	UnaryClientInterceptor()(ctx, "/cache.Cache/Get", nil, nil, nil, invoker)
+
+	assert.Equal(t, []string{"abc123"}, md.Get("x-request-id"))
+}
+
+func TestInterceptorDoesNothingWithoutID(t *testing.T) {
+	var md metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+
+	UnaryClientInterceptor()(context.Background(), "/cache.Cache/Get", nil, nil, nil, invoker)
+
+	assert.Empty(t, md.Get("x-request-id"))
+}
@@ -0,0 +1,181 @@
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emojify-app/api/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// IdempotencyKey is the gRPC metadata key which marks a call as safe to retry
+// regardless of the method
+const IdempotencyKey = "idempotency-key"
+
+// Config configures the retries for a single upstream
+type Config struct {
+	// MaxAttempts is the maximum number of attempts including the first call,
+	// 1 disables retries
+	MaxAttempts int
+	// InitialBackoff is the maximum wait before the first retry, the maximum
+	// doubles for every following retry and the actual wait is a random
+	// duration up to the maximum
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration
+	// BudgetRatio is the number of retries earned by each call, retries stop
+	// when the budget is spent so that a failing upstream does not receive
+	// more than 1+BudgetRatio times the normal traffic
+	BudgetRatio float64
+	// BudgetMax is the maximum number of retries which can be saved, the
+	// budget starts full
+	BudgetMax float64
+	// Methods are the names of methods, without the service, which are
+	// idempotent and may be retried. Other methods are only retried when the
+	// outgoing metadata contains an idempotency key.
+	Methods []string
+}
+
+// Retryer retries failed calls to an upstream
+type Retryer struct {
+	upstream string
+	config   Config
+	logger   logging.Logger
+	methods  map[string]bool
+
+	mutex  sync.Mutex
+	tokens float64
+
+	random func() float64
+	sleep  func(ctx context.Context, d time.Duration) error
+}
+
+// New creates a Retryer for the upstream, the name identifies the upstream in
+// logs and metrics
+func New(upstream string, config Config, l logging.Logger) *Retryer {
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+
+	methods := map[string]bool{}
+	for _, m := range config.Methods {
+		methods[m] = true
+	}
+
+	return &Retryer{
+		upstream: upstream,
+		config:   config,
+		logger:   l,
+		methods:  methods,
+		tokens:   config.BudgetMax,
+		random:   rand.Float64,
+		sleep:    sleep,
+	}
+}
+
+// UnaryClientInterceptor returns a gRPC interceptor which retries calls which
+// fail with Unavailable or ResourceExhausted
+func (r *Retryer) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		r.deposit()
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil || !r.retryable(ctx, method) {
+			return err
+		}
+
+		for attempt := 1; attempt < r.config.MaxAttempts && retryableError(err); attempt++ {
+			if !r.withdraw() {
+				r.logger.WithContext(ctx).UpstreamRetryBudgetExhausted(r.upstream, method)
+				return err
+			}
+
+			if serr := r.sleep(ctx, r.backoff(attempt)); serr != nil {
+				return err
+			}
+
+			r.logger.WithContext(ctx).UpstreamRetry(r.upstream, method, attempt, err)
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		return err
+	}
+}
+
+// retryable returns true when the method is idempotent or the call has an
+// idempotency key
+func (r *Retryer) retryable(ctx context.Context, method string) bool {
+	if r.methods[method[strings.LastIndex(method, "/")+1:]] {
+		return true
+	}
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return len(md.Get(IdempotencyKey)) > 0
+}
+
+// retryableError returns true when the upstream rejected the call before
+// processing it
+func retryableError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	}
+
+	return false
+}
+
+// backoff returns a random duration up to InitialBackoff*2^(attempt-1) capped
+// at MaxBackoff
+func (r *Retryer) backoff(attempt int) time.Duration {
+	max := r.config.InitialBackoff << uint(attempt-1)
+	if max > r.config.MaxBackoff || max <= 0 {
+		max = r.config.MaxBackoff
+	}
+
+	return time.Duration(r.random() * float64(max))
+}
+
+// deposit adds the budget earned by a call, the balance is capped so that a
+// long period of success does not allow a burst of retries
+func (r *Retryer) deposit() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.tokens += r.config.BudgetRatio
+	if r.tokens > r.config.BudgetMax {
+		r.tokens = r.config.BudgetMax
+	}
+}
+
+// withdraw spends the budget for a single retry, returns false when the
+// budget is exhausted
+func (r *Retryer) withdraw() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.tokens < 1 {
+		return false
+	}
+
+	r.tokens--
+	return true
+}
+
+// sleep waits for d or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
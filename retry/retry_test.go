@@ -0,0 +1,133 @@
+package retry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emojify-app/api/logging"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func setupRetryer(config Config) (*Retryer, *logging.InMemorySink, *[]time.Duration) {
+	sink := logging.NewInMemorySink()
+	r := New("cache", config, logging.New("test", sink, "error", "text"))
+
+	var waits []time.Duration
+	r.random = func() float64 { return 1 }
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+
+	return r, sink, &waits
+}
+
+func testConfig() Config {
+	return Config{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     15 * time.Millisecond,
+		BudgetRatio:    0.1,
+		BudgetMax:      10,
+		Methods:        []string{"Get"},
+	}
+}
+
+// invoker returns an invoker which fails with the given errors in order and
+// then succeeds, calls records the number of calls
+func invoker(calls *int, errs ...error) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		*calls++
+		if *calls <= len(errs) {
+			return errs[*calls-1]
+		}
+
+		return nil
+	}
+}
+
+var errUnavailable = status.Error(codes.Unavailable, "down")
+
+func TestRetriesIdempotentMethodWithBackoff(t *testing.T) {
+	r, sink, waits := setupRetryer(testConfig())
+	calls := 0
+
+	err := r.UnaryClientInterceptor()(context.Background(), "/Cache/Get", nil, nil, nil, invoker(&calls, errUnavailable, status.Error(codes.ResourceExhausted, "busy")))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 15 * time.Millisecond}, *waits)
+	assert.Equal(t, 2, sink.Count("service.api.upstream.retry"))
+}
+
+func TestStopsAfterMaxAttempts(t *testing.T) {
+	r, _, _ := setupRetryer(testConfig())
+	calls := 0
+
+	err := r.UnaryClientInterceptor()(context.Background(), "/Cache/Get", nil, nil, nil, invoker(&calls, errUnavailable, errUnavailable, errUnavailable, errUnavailable))
+
+	assert.Equal(t, errUnavailable, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestDoesNotRetryOtherErrors(t *testing.T) {
+	r, _, _ := setupRetryer(testConfig())
+	calls := 0
+
+	err := r.UnaryClientInterceptor()(context.Background(), "/Cache/Get", nil, nil, nil, invoker(&calls, status.Error(codes.Internal, "boom")))
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestDoesNotRetryNonIdempotentMethod(t *testing.T) {
+	r, _, _ := setupRetryer(testConfig())
+	calls := 0
+
+	err := r.UnaryClientInterceptor()(context.Background(), "/emojify.Emojify/Create", nil, nil, nil, invoker(&calls, errUnavailable))
+
+	assert.Equal(t, errUnavailable, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetriesNonIdempotentMethodWithIdempotencyKey(t *testing.T) {
+	r, _, _ := setupRetryer(testConfig())
+	calls := 0
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), IdempotencyKey, "abc")
+	err := r.UnaryClientInterceptor()(ctx, "/emojify.Emojify/Create", nil, nil, nil, invoker(&calls, errUnavailable))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestStopsWhenBudgetExhausted(t *testing.T) {
+	c := testConfig()
+	c.BudgetMax = 1
+	r, sink, _ := setupRetryer(c)
+	calls := 0
+
+	err := r.UnaryClientInterceptor()(context.Background(), "/Cache/Get", nil, nil, nil, invoker(&calls, errUnavailable, errUnavailable, errUnavailable))
+
+	assert.Equal(t, errUnavailable, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, sink.Count("service.api.upstream.retry_budget_exhausted"))
+}
+
+func TestStopsWhenContextDone(t *testing.T) {
+	r, _, _ := setupRetryer(testConfig())
+	calls := 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := r.UnaryClientInterceptor()(ctx, "/Cache/Get", nil, nil, nil, invoker(&calls, errUnavailable))
+
+	assert.Equal(t, errUnavailable, err)
+	assert.Equal(t, 1, calls)
+}
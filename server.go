@@ -1,19 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/nicholasjackson/env"
 	"google.golang.org/grpc"
 
+	"github.com/emojify-app/api/auth"
+	"github.com/emojify-app/api/breaker"
 	"github.com/emojify-app/api/handlers"
 	"github.com/emojify-app/api/logging"
+	"github.com/emojify-app/api/requestid"
+	"github.com/emojify-app/api/retry"
+	"github.com/emojify-app/api/tracing"
 	"github.com/emojify-app/cache/protos/cache"
 	"github.com/emojify-app/emojify/protos/emojify"
 	"github.com/rs/cors"
@@ -28,19 +38,102 @@ var version = "dev"
 
 var bindAddress = env.String("BIND_ADDRESS", false, "localhost:9090", "Bind address for the server defaults to localhost:9090")
 var path = env.String("API_PATH", false, "/", "Path to mount API, defaults to /")
+var drainPeriod = env.Duration("SHUTDOWN_DRAIN_PERIOD", false, 30*time.Second, "Time to wait for in-flight requests to complete on shutdown [30s,500ms]")
 
 // authentication flags
 var allowedOrigin = env.String("ALLOW_ORIGIN", false, "*", "CORS origin")
 
 // external service flags
 var statsDServer = env.String("STATSD_SERVER", false, "localhost:8125", "StatsD server location")
+var metricsBackend = env.String("METRICS_BACKEND", false, "statsd", "Metrics backend [statsd,prometheus,both], Prometheus metrics are served at /metrics")
 var emojifyAddress = env.String("EMOJIFY_ADDRESS", false, "localhost", "Address for the Emojify service")
 var cacheAddress = env.String("CACHE_ADDRESS", false, "localhost", "Address for the Cache service")
-var paymentGatewayURI = env.String("PAYMENT_ADDRESS", false, "localhost", "Address for the Payment gateway service")
+var paymentGatewayURI = env.String("PAYMENT_ADDRESS", false, "http://localhost", "URL of the Payment gateway service")
+var paymentTimeout = env.Duration("PAYMENT_TIMEOUT", false, 10*time.Second, "Maximum time to wait for the Payment gateway, 0 disables the timeout [10s,500ms]")
+var emojifyTimeout = env.Duration("EMOJIFY_TIMEOUT", false, 5*time.Second, "Maximum time to wait for the Emojify service, 0 disables the timeout [5s,500ms]")
+var maxUploadSize = env.Int("MAX_UPLOAD_SIZE", false, 10000000, "Maximum size in bytes of a POST body or uploaded image, defaults to 10MB")
+var uploadBaseURL = env.String("UPLOAD_BASE_URL", false, "", "URL where the Emojify service can fetch uploaded images from this API, defaults to http://BIND_ADDRESS/API_PATH")
+var eventsMinInterval = env.Duration("EVENTS_MIN_INTERVAL", false, 500*time.Millisecond, "Minimum interval between polls of the Emojify service when streaming job events")
+var eventsMaxInterval = env.Duration("EVENTS_MAX_INTERVAL", false, 5*time.Second, "Maximum interval between polls of the Emojify service when streaming job events")
+var eventsTimeout = env.Duration("EVENTS_TIMEOUT", false, 5*time.Minute, "Maximum duration of a job event stream")
+var wsMaxJobs = env.Int("WEBSOCKET_MAX_JOBS", false, 20, "Maximum number of unfinished jobs tracked by a WebSocket connection")
+var wsPollInterval = env.Duration("WEBSOCKET_POLL_INTERVAL", false, 1*time.Second, "Interval between queries for the status of jobs tracked by a WebSocket connection")
+var wsPingInterval = env.Duration("WEBSOCKET_PING_INTERVAL", false, 30*time.Second, "Interval between heartbeat pings sent to WebSocket clients")
+var batchMaxSize = env.Int("BATCH_MAX_SIZE", false, 50, "Maximum number of URLs or ids in a batch create or query request")
+var batchConcurrency = env.Int("BATCH_CONCURRENCY", false, 5, "Maximum number of concurrent calls to the Emojify service for a batch create or query request")
+var healthProbeInterval = env.Duration("HEALTH_PROBE_INTERVAL", false, 10*time.Second, "Interval between background health checks of the Cache and Emojify services")
+var healthCritical = env.String("HEALTH_CRITICAL_DEPENDENCIES", false, "emojify", "Comma separated list of dependencies [cache,emojify] which must be healthy for /health/ready to succeed")
+var idempotencyTTL = env.Duration("IDEMPOTENCY_TTL", false, 24*time.Hour, "Time the response for an Idempotency-Key is kept, 0 ignores the header")
+var idempotencyMaxKeys = env.Int("IDEMPOTENCY_MAX_KEYS", false, 100000, "Maximum number of Idempotency-Key responses kept, the oldest is removed when full, 0 is unlimited")
+var cacheMaxAge = env.Duration("CACHE_MAX_AGE", false, 365*24*time.Hour, "Time clients and CDNs may cache images served from /cache")
+var cacheTimeout = env.Duration("CACHE_TIMEOUT", false, 2*time.Second, "Maximum time to wait for the Cache service, 0 disables the timeout [2s,500ms]")
+
+// circuit breaker settings apply to the Cache and Emojify clients
+var breakerFailureThreshold = env.Int("BREAKER_FAILURE_THRESHOLD", false, 5, "Number of consecutive upstream failures which open the circuit breaker")
+var breakerResetTimeout = env.Duration("BREAKER_RESET_TIMEOUT", false, 10*time.Second, "Time the circuit breaker stays open before allowing trial calls [10s,500ms]")
+var breakerHalfOpenRequests = env.Int("BREAKER_HALF_OPEN_REQUESTS", false, 1, "Number of trial calls which must succeed to close the circuit breaker")
+
+// retry settings, idempotent calls which fail with Unavailable or
+// ResourceExhausted are retried with jittered exponential backoff
+var cacheRetryMaxAttempts = env.Int("CACHE_RETRY_MAX_ATTEMPTS", false, 3, "Maximum attempts for idempotent calls to the Cache service, 1 disables retries")
+var cacheRetryInitialBackoff = env.Duration("CACHE_RETRY_INITIAL_BACKOFF", false, 50*time.Millisecond, "Maximum wait before the first retry of a call to the Cache service")
+var cacheRetryMaxBackoff = env.Duration("CACHE_RETRY_MAX_BACKOFF", false, 1*time.Second, "Maximum wait between retries of a call to the Cache service")
+var cacheRetryBudget = env.Float64("CACHE_RETRY_BUDGET", false, 0.2, "Retries earned by each call to the Cache service")
+var emojifyRetryMaxAttempts = env.Int("EMOJIFY_RETRY_MAX_ATTEMPTS", false, 3, "Maximum attempts for idempotent calls to the Emojify service, 1 disables retries")
+var emojifyRetryInitialBackoff = env.Duration("EMOJIFY_RETRY_INITIAL_BACKOFF", false, 100*time.Millisecond, "Maximum wait before the first retry of a call to the Emojify service")
+var emojifyRetryMaxBackoff = env.Duration("EMOJIFY_RETRY_MAX_BACKOFF", false, 2*time.Second, "Maximum wait between retries of a call to the Emojify service")
+var emojifyRetryBudget = env.Float64("EMOJIFY_RETRY_BUDGET", false, 0.2, "Retries earned by each call to the Emojify service")
+
+// authentication settings, clients authenticate with an API key in the
+// X-Api-Key header or a JWT bearer token
+var authAPIKeys = env.String("AUTH_API_KEYS", false, "", "API keys separated by ; in the format \"key subject [role,role]\"")
+var authAPIKeysFile = env.String("AUTH_API_KEYS_FILE", false, "", "File containing API keys, one per line in the format \"key subject [role,role]\"")
+var authJWTSecret = env.String("AUTH_JWT_SECRET", false, "", "HMAC secret used to validate JWT bearer tokens")
+var authJWKSFile = env.String("AUTH_JWKS_FILE", false, "", "JSON Web Key Set file containing the public keys used to validate JWT bearer tokens")
+var authJWTIssuer = env.String("AUTH_JWT_ISSUER", false, "", "Required issuer of JWT bearer tokens, empty accepts any issuer")
+var authJWTAudience = env.String("AUTH_JWT_AUDIENCE", false, "", "Required audience of JWT bearer tokens, empty accepts any audience")
+var authRequired = env.String("AUTH_REQUIRED_ROUTES", false, "", "Comma separated list of route groups [emojify,cache,payment] which require authentication")
+var authFailureRateLimit = env.Float64("AUTH_FAILURE_RATE_LIMIT", false, 0.1, "Requests with invalid credentials per second each client IP can make before it is rejected, 0 disables the limit")
+var authFailureRateLimitBurst = env.Int("AUTH_FAILURE_RATE_LIMIT_BURST", false, 10, "Requests with invalid credentials each client IP can make at once")
+
+// job ownership settings, the owner of each job is recorded when
+// authentication is configured
+var jobsTTL = env.Duration("JOBS_TTL", false, 24*time.Hour, "Time the owners of a job are kept, after which the job can only be queried by admins until it is created again")
+var jobsMaxPerSubject = env.Int("JOBS_MAX_PER_SUBJECT", false, 100, "Maximum number of recent jobs kept for each authenticated client")
+
+// quota settings limit the jobs created by each authenticated client
+var quotaDaily = env.Int("QUOTA_DAILY", false, 0, "Jobs each authenticated client can create per day, 0 is unlimited")
+var quotaMonthly = env.Int("QUOTA_MONTHLY", false, 0, "Jobs each authenticated client can create per month, 0 is unlimited")
+var quotaStore = env.String("QUOTA_STORE", false, "memory", "Store for quota usage [memory,bolt], memory usage is lost on restart")
+var quotaBoltFile = env.String("QUOTA_BOLT_FILE", false, "quota.db", "BoltDB file used when QUOTA_STORE is bolt")
+
+// rate limit settings, each client has a token bucket per route group
+var rateLimitKey = env.String("RATE_LIMIT_KEY", false, "ip", "Identifies the client for rate limiting [ip,api_key,subject], api_key and subject require authentication, requests which are not authenticated are limited by IP")
+var rateLimitTrustedProxies = env.String("RATE_LIMIT_TRUSTED_PROXIES", false, "", "Comma separated list of IP addresses or CIDR ranges of proxies whose X-Forwarded-For header is used to find the client IP")
+var emojifyRateLimit = env.Float64("EMOJIFY_RATE_LIMIT", false, 10, "Requests per second each client can make to the emojify routes, 0 disables the limit")
+var emojifyRateLimitBurst = env.Int("EMOJIFY_RATE_LIMIT_BURST", false, 20, "Requests each client can make at once to the emojify routes")
+var cacheRateLimit = env.Float64("CACHE_RATE_LIMIT", false, 50, "Requests per second each client can make to the cache routes, 0 disables the limit")
+var cacheRateLimitBurst = env.Int("CACHE_RATE_LIMIT_BURST", false, 100, "Requests each client can make at once to the cache routes")
+
+// url policy settings restrict the image URLs which can be submitted
+var urlAllowedSchemes = env.String("URL_ALLOWED_SCHEMES", false, "http,https", "Comma separated list of schemes permitted for image URLs")
+var urlAllowedHosts = env.String("URL_ALLOWED_HOSTS", false, "", "Comma separated list of hosts permitted for image URLs, *.example.com matches subdomains, empty allows all")
+var urlDeniedHosts = env.String("URL_DENIED_HOSTS", false, "", "Comma separated list of hosts denied for image URLs, *.example.com matches subdomains")
+var urlAllowedPorts = env.String("URL_ALLOWED_PORTS", false, "80,443", "Comma separated list of ports permitted for image URLs, empty allows all")
+var urlAllowPrivateIPs = env.Bool("URL_ALLOW_PRIVATE_IPS", false, false, "Allow image URLs which resolve to loopback, link-local or private addresses")
+
+// tracing settings
+var tracingExporter = env.String("TRACING_EXPORTER", false, "none", "Exporter for trace spans [none,zipkin,file], trace headers are propagated to upstreams for all exporters")
+var tracingEndpoint = env.String("TRACING_ENDPOINT", false, "http://localhost:9411/api/v2/spans", "URL of the Zipkin collector when TRACING_EXPORTER is zipkin")
+var tracingFile = env.String("TRACING_FILE", false, "traces.json", "File spans are appended to when TRACING_EXPORTER is file")
+var tracingSampleRatio = env.Float64("TRACING_SAMPLE_RATIO", false, 1.0, "Fraction of new traces which are sampled, requests with a sampled parent are always sampled")
 
 // logging settings
 var logFormat = env.String("LOG_FORMAT", false, "text", "Log output format [text,json]")
 var logLevel = env.String("LOG_LEVEL", false, "info", "Log output level [trace,info,debug,warn,error]")
+var accessLogFormat = env.String("ACCESS_LOG_FORMAT", false, "clf", "Access log format written to stdout [none,clf,json,logfmt]")
+var accessLogSampleRate = env.Float64("ACCESS_LOG_SAMPLE_RATE", false, 1.0, "Fraction of requests written to the access log, 5xx responses are always logged")
+var accessLogExclude = env.String("ACCESS_LOG_EXCLUDE", false, "health,metrics", "Comma separated list of paths relative to API_PATH which are not written to the access log")
 
 // performance testing flags
 // these flags allow the user to inject faults into the service for testing purposes
@@ -70,19 +163,38 @@ func main() {
 	}
 
 	// configure the logger
-	logger, err := logging.New("api", version, *statsDServer, *logLevel, *logFormat)
+	sink, metricsHandler, err := logging.NewMetricsSink(*metricsBackend, version, *statsDServer)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	logger := logging.New("api", sink, *logLevel, *logFormat)
+
 	logger.ServiceStart(*bindAddress, version)
 	logger.Log().Info(
 		"Startup parameters",
 		"statsDServer", *statsDServer,
+		"metricsBackend", *metricsBackend,
+		"tracingExporter", *tracingExporter,
 		"allowedOrigin", *allowedOrigin,
+		"paymentGatewayURI", *paymentGatewayURI,
 	)
 
+	// configure tracing
+	shutdownTracing, err := tracing.New(tracing.Config{
+		ServiceName: "api",
+		Version:     version,
+		Exporter:    *tracingExporter,
+		Endpoint:    *tracingEndpoint,
+		File:        *tracingFile,
+		SampleRatio: *tracingSampleRatio,
+	})
+	if err != nil {
+		logger.Log().Error("Unable to configure tracing", "error", err)
+		os.Exit(1)
+	}
+
 	// if the user has configured a path, make sure it ends in a /
 	if !strings.HasSuffix(*path, "/") {
 		*path = *path + "/"
@@ -90,32 +202,210 @@ func main() {
 
 	logger.Log().Info("Api listening on", "path", *path)
 
-	// create the cache client
+	// uploaded images are served to the emojify service by the cache handler
+	if *uploadBaseURL == "" {
+		*uploadBaseURL = "http://" + *bindAddress + *path
+	}
+
+	// create the cache client, each retry is traced as a separate call
 	logger.Log().Info("Connecting to cache", "address", *cacheAddress)
-	cacheConn, err := grpc.Dial(*cacheAddress, grpc.WithInsecure())
+	cacheRetry := retry.New("cache", retry.Config{
+		MaxAttempts:    *cacheRetryMaxAttempts,
+		InitialBackoff: *cacheRetryInitialBackoff,
+		MaxBackoff:     *cacheRetryMaxBackoff,
+		BudgetRatio:    *cacheRetryBudget,
+		BudgetMax:      10,
+		Methods:        []string{"Check", "Get", "Exists"},
+	}, logger)
+
+	cacheConn, err := grpc.Dial(
+		*cacheAddress,
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(
+			cacheRetry.UnaryClientInterceptor(),
+			tracing.UnaryClientInterceptor(),
+			requestid.UnaryClientInterceptor(),
+		),
+	)
 	if err != nil {
 		logger.Log().Error("Unable to create cache gRPC client", err)
 		os.Exit(1)
 	}
-	cacheClient := cache.NewCacheClient(cacheConn)
+	breakerConfig := breaker.Config{
+		FailureThreshold: *breakerFailureThreshold,
+		ResetTimeout:     *breakerResetTimeout,
+		HalfOpenRequests: *breakerHalfOpenRequests,
+	}
+
+	cacheBreaker := breaker.New("cache", breakerConfig, logger)
+	cacheClient := breaker.NewCacheClient(cache.NewCacheClient(cacheConn), cacheBreaker)
 
 	// create the emojify client
+	// Create is only retried when the request has an idempotency key
 	logger.Log().Info("Connecting to emojify", "address", *emojifyAddress)
-	emojifyConn, err := grpc.Dial(*emojifyAddress, grpc.WithInsecure())
+	emojifyRetry := retry.New("emojify", retry.Config{
+		MaxAttempts:    *emojifyRetryMaxAttempts,
+		InitialBackoff: *emojifyRetryInitialBackoff,
+		MaxBackoff:     *emojifyRetryMaxBackoff,
+		BudgetRatio:    *emojifyRetryBudget,
+		BudgetMax:      10,
+		Methods:        []string{"Check", "Query"},
+	}, logger)
+
+	emojifyConn, err := grpc.Dial(
+		*emojifyAddress,
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(
+			emojifyRetry.UnaryClientInterceptor(),
+			tracing.UnaryClientInterceptor(),
+			requestid.UnaryClientInterceptor(),
+		),
+	)
 	if err != nil {
 		logger.Log().Error("Unable to create emojify gRPC client", err)
 		os.Exit(1)
 	}
-	emojifyClient := emojify.NewEmojifyClient(emojifyConn)
+	emojifyBreaker := breaker.New("emojify", breakerConfig, logger)
+	emojifyClient := breaker.NewEmojifyClient(emojify.NewEmojifyClient(emojifyConn), emojifyBreaker)
+
+	// configure the policy for submitted image URLs
+	urlPolicy := &handlers.URLPolicy{
+		AllowedSchemes:  splitList(*urlAllowedSchemes),
+		AllowedHosts:    splitList(*urlAllowedHosts),
+		DeniedHosts:     splitList(*urlDeniedHosts),
+		AllowPrivateIPs: *urlAllowPrivateIPs,
+	}
+
+	for _, p := range splitList(*urlAllowedPorts) {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			logger.Log().Error("Invalid port in URL_ALLOWED_PORTS", "port", p, "error", err)
+			os.Exit(1)
+		}
+
+		urlPolicy.AllowedPorts = append(urlPolicy.AllowedPorts, port)
+	}
+
+	// configure authentication
+	authenticator, err := createAuthenticator()
+	if err != nil {
+		logger.Log().Error("Unable to configure authentication", "error", err)
+		os.Exit(1)
+	}
+
+	required := map[string]bool{}
+	for _, g := range splitList(*authRequired) {
+		required[g] = true
+	}
+
+	if authenticator == nil && len(required) > 0 {
+		logger.Log().Error("AUTH_REQUIRED_ROUTES is set but no API keys or JWT validation are configured")
+		os.Exit(1)
+	}
+
+	// the owners of jobs are only recorded when clients can authenticate
+	var jobStore handlers.JobStore
+	if authenticator != nil {
+		jobStore = handlers.NewMemoryJobStore(*jobsTTL, *jobsMaxPerSubject)
+	}
 
 	// create handlers
-	hh := handlers.NewHealth(logger, emojifyClient, cacheClient)
-	ch := handlers.NewCache(logger, cacheClient)
-	ehp := handlers.NewEmojifyPost(logger, emojifyClient)
-	ehg := handlers.NewEmojifyGet(logger, emojifyClient)
+	hh := handlers.NewHealth(logger, emojifyClient, cacheClient, *emojifyTimeout, *cacheTimeout)
+	critical := map[string]bool{}
+	for _, d := range splitList(*healthCritical) {
+		critical[d] = true
+	}
+
+	cacheDependency := handlers.CacheDependency(cacheClient, *cacheTimeout, critical["cache"])
+	cacheDependency.Breaker = cacheBreaker
+
+	emojifyDependency := handlers.EmojifyDependency(emojifyClient, *emojifyTimeout, critical["emojify"])
+	emojifyDependency.Breaker = emojifyBreaker
+
+	prober := handlers.NewHealthProber(logger, *healthProbeInterval, cacheDependency, emojifyDependency)
+	prober.Start()
+
+	hlh := handlers.NewHealthLive(logger)
+	hrh := handlers.NewHealthReady(logger, prober)
+	hdh := handlers.NewHealthDetails(logger, prober)
+	ch := handlers.NewCache(logger, cacheClient, *cacheTimeout, jobStore, *cacheMaxAge)
+	uh := handlers.NewUploads(logger, cacheClient, *cacheTimeout, *cacheMaxAge)
+
+	// the client IP of requests from trusted proxies is found with the
+	// X-Forwarded-For header
+	trustedProxies, err := parseNetworks(splitList(*rateLimitTrustedProxies))
+	if err != nil {
+		logger.Log().Error("Unable to parse trusted proxies", "error", err)
+		os.Exit(1)
+	}
+
+	idempotency := handlers.Idempotency{TrustedProxies: trustedProxies}
+	if *idempotencyTTL > 0 {
+		idempotency.Store = handlers.NewMemoryIdempotencyStore(*idempotencyTTL, *idempotencyMaxKeys)
+	}
+
+	var quota *handlers.Quota
+	if *quotaDaily > 0 || *quotaMonthly > 0 {
+		quota = &handlers.Quota{Daily: *quotaDaily, Monthly: *quotaMonthly}
+
+		switch *quotaStore {
+		case "memory":
+			quota.Store = handlers.NewMemoryQuotaStore()
+		case "bolt":
+			bs, err := handlers.NewBoltQuotaStore(*quotaBoltFile)
+			if err != nil {
+				logger.Log().Error("Unable to open quota store", "file", *quotaBoltFile, "error", err)
+				os.Exit(1)
+			}
+			defer bs.Close()
+
+			quota.Store = bs
+		default:
+			logger.Log().Error("Unknown quota store", "store", *quotaStore)
+			os.Exit(1)
+		}
+	}
+
+	ehp := handlers.NewEmojifyPost(logger, emojifyClient, *emojifyTimeout, handlers.ImageUploads{
+		Cache:   cacheClient,
+		BaseURL: *uploadBaseURL,
+		MaxSize: int64(*maxUploadSize),
+		Timeout: *cacheTimeout,
+	}, urlPolicy, idempotency, quota, jobStore)
+	ehg := handlers.NewEmojifyGet(logger, emojifyClient, *emojifyTimeout, jobStore)
+	ehb := handlers.NewEmojifyBatch(logger, ehp, handlers.BatchConfig{
+		MaxSize:     *batchMaxSize,
+		Concurrency: *batchConcurrency,
+	})
+	ehq := handlers.NewEmojifyBatchGet(logger, ehg, handlers.BatchConfig{
+		MaxSize:     *batchMaxSize,
+		Concurrency: *batchConcurrency,
+	})
+	ehw := handlers.NewEmojifyWebSocket(logger, ehp, handlers.WebSocketConfig{
+		MaxJobs:       *wsMaxJobs,
+		PollInterval:  *wsPollInterval,
+		PingInterval:  *wsPingInterval,
+		PongTimeout:   *wsPingInterval * 2,
+		AllowedOrigin: *allowedOrigin,
+	})
+	ehe := handlers.NewEmojifyEvents(logger, emojifyClient, *emojifyTimeout, handlers.EventPolling{
+		MinInterval: *eventsMinInterval,
+		MaxInterval: *eventsMaxInterval,
+		Timeout:     *eventsTimeout,
+	}, jobStore)
+	ehm := handlers.NewEmojifyMine(logger, ehg, jobStore, handlers.BatchConfig{
+		MaxSize:     *batchMaxSize,
+		Concurrency: *batchConcurrency,
+	})
+	ph, err := handlers.NewPayment(logger, *paymentGatewayURI, *paymentTimeout)
+	if err != nil {
+		logger.Log().Error("Unable to create payment handler", "error", err)
+		os.Exit(1)
+	}
 
 	// configure routing
 	r := mux.NewRouter()
+	r.Use(tracing.Middleware)
 
 	// add profiling
 	// r.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
@@ -123,11 +413,90 @@ func main() {
 	baseRouter := r.PathPrefix(*path).Subrouter()                // base subrouter with no middleware
 	cacheRouter := r.PathPrefix(*path + "cache").Subrouter()     // caching subrouter
 	emojifyRouter := r.PathPrefix(*path + "emojify").Subrouter() // caching subrouter
+	paymentRouter := r.PathPrefix(*path + "payment").Subrouter() // payment subrouter
+
+	// uploaded images are fetched by the emojify service, the router is not
+	// authenticated or rate limited
+	uploadsRouter := r.PathPrefix(*path + "uploads").Subrouter()
 
 	baseRouter.Handle("/health", hh).Methods("GET")
+	baseRouter.Handle("/health/live", hlh).Methods("GET")
+	baseRouter.Handle("/health/ready", hrh).Methods("GET")
+	baseRouter.Handle("/health/details", hdh).Methods("GET")
+
+	if metricsHandler != nil {
+		baseRouter.Handle("/metrics", metricsHandler).Methods("GET")
+	}
 	emojifyRouter.Handle("/", ehp).Methods("POST")
+	emojifyRouter.Handle("", ehq).Methods("GET").Queries("ids", "{ids}")
+	emojifyRouter.Handle("/", ehq).Methods("GET").Queries("ids", "{ids}")
+	emojifyRouter.Handle("/batch", ehb).Methods("POST")
+	emojifyRouter.Handle("/status", ehq).Methods("POST")
+	emojifyRouter.Handle("/ws", ehw).Methods("GET")
+	if jobStore != nil {
+		emojifyRouter.Handle("/mine", ehm).Methods("GET")
+	}
 	emojifyRouter.Handle("/{id}", ehg).Methods("GET")
+	emojifyRouter.Handle("/{id}/events", ehe).Methods("GET")
 	cacheRouter.Handle("/{id}", ch).Methods("GET")
+	uploadsRouter.Handle("/{id}", uh).Methods("GET")
+	paymentRouter.Handle("", ph).Methods("POST")
+
+	// authenticate requests before they are rate limited so clients can be
+	// limited by subject, failed attempts are limited by IP before the
+	// credentials are checked so they can not be guessed at the request rate
+	if authenticator != nil {
+		var failures *handlers.RateLimiter
+		if *authFailureRateLimit > 0 {
+			failures, err = handlers.NewRateLimiter(logger, "auth", handlers.RateLimit{
+				Rate:           *authFailureRateLimit,
+				Burst:          *authFailureRateLimitBurst,
+				Key:            handlers.RateLimitKeyIP,
+				TrustedProxies: trustedProxies,
+			})
+			if err != nil {
+				logger.Log().Error("Unable to create rate limiter", "group", "auth", "error", err)
+				os.Exit(1)
+			}
+		}
+
+		authRoutes := map[string]*mux.Router{"emojify": emojifyRouter, "cache": cacheRouter, "payment": paymentRouter}
+		for g, router := range authRoutes {
+			router.Use(handlers.NewAuthentication(logger, g, authenticator, required[g], failures).Middleware)
+		}
+	}
+
+	// limit the rate of requests from each client, rejected requests do not
+	// reach the error injection middleware
+	rateLimits := []struct {
+		group  string
+		router *mux.Router
+		rate   float64
+		burst  int
+	}{
+		{"emojify", emojifyRouter, *emojifyRateLimit, *emojifyRateLimitBurst},
+		{"cache", cacheRouter, *cacheRateLimit, *cacheRateLimitBurst},
+	}
+
+	for _, rl := range rateLimits {
+		if rl.rate <= 0 {
+			continue
+		}
+
+		limiter, err := handlers.NewRateLimiter(logger, rl.group, handlers.RateLimit{
+			Rate:           rl.rate,
+			Burst:          rl.burst,
+			Key:            *rateLimitKey,
+			Authenticated:  authenticator != nil,
+			TrustedProxies: trustedProxies,
+		})
+		if err != nil {
+			logger.Log().Error("Unable to create rate limiter", "group", rl.group, "error", err)
+			os.Exit(1)
+		}
+
+		rl.router.Use(limiter.Middleware)
+	}
 
 	// Setup error injection for testing
 	if *cacheErrorRate != 0.0 {
@@ -153,13 +522,195 @@ func main() {
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{*allowedOrigin},
 		AllowCredentials: true,
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", requestid.Header, auth.APIKeyHeader, handlers.IdempotencyKeyHeader, "Range", "If-Range", "If-None-Match"},
+		ExposedHeaders:   []string{requestid.Header, "ETag", "Content-Range", "Accept-Ranges", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", handlers.QuotaRemainingHeader},
 		Debug:            false,
 	})
 
-	handler := c.Handler(r)
+	// log every request, paths are excluded relative to the API path
+	var excludePaths []string
+	for _, p := range splitList(*accessLogExclude) {
+		excludePaths = append(excludePaths, *path+strings.TrimPrefix(p, "/"))
+	}
+
+	accessLog, err := logging.NewAccessLog(os.Stdout, r, logging.AccessLogConfig{
+		Format:       *accessLogFormat,
+		SampleRate:   *accessLogSampleRate,
+		ExcludePaths: excludePaths,
+		ClientIP:     handlers.ClientIP(trustedProxies),
+	})
+	if err != nil {
+		logger.Log().Error("Unable to create access log", "error", err)
+		os.Exit(1)
+	}
+
+	// the request id is assigned before the access log so every line, including
+	// requests which do not match a route, contains the id. CORS runs inside
+	// the access log so preflight requests answered by CORS are logged.
+	handler := requestid.Middleware(accessLog.Middleware(c.Handler(r)))
+
+	// streams such as SSE and WebSockets are ended when the server begins
+	// shutting down, other requests are left to complete during the drain
+	// period
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+
+	server := &http.Server{
+		Addr:    *bindAddress,
+		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return handlers.WithShutdown(context.Background(), shutdownCtx)
+		},
+	}
+	server.RegisterOnShutdown(shutdown)
+
+	go func() {
+		logger.Log().Info("Starting server")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Log().Error("Unable to start server", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// block until we receive a signal to terminate
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigChan
+
+	logger.ServiceStopping(sig.String(), *drainPeriod)
+
+	// stop accepting new connections and wait for in-flight requests to
+	// complete, requests still running after the drain period are dropped
+	ctx, cancel := context.WithTimeout(context.Background(), *drainPeriod)
+	defer cancel()
+	err = server.Shutdown(ctx)
+
+	// upgraded WebSocket connections are not tracked by the server, wait for
+	// them to close after the going away message
+	if werr := ehw.Wait(ctx); err == nil {
+		err = werr
+	}
+
+	// in-flight handlers have finished with the upstreams, stop the health
+	// checks and close the connections
+	prober.Stop()
+
+	if cerr := cacheConn.Close(); cerr != nil {
+		logger.Log().Error("Unable to close cache gRPC connection", "error", cerr)
+	}
+
+	if cerr := emojifyConn.Close(); cerr != nil {
+		logger.Log().Error("Unable to close emojify gRPC connection", "error", cerr)
+	}
+
+	// flush any buffered spans, the drain context may already have expired
+	tctx, tcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer tcancel()
+
+	if terr := shutdownTracing(tctx); terr != nil {
+		logger.Log().Error("Unable to flush trace spans", "error", terr)
+	}
+
+	logger.ServiceStopped(err)
+
+	// flush any remaining metrics
+	if cerr := logger.Close(); cerr != nil {
+		fmt.Println("Unable to flush metrics", cerr)
+	}
+}
+
+// createAuthenticator creates an authenticator for the configured API keys
+// and JWT validation, returns nil when neither is configured
+func createAuthenticator() (auth.Authenticator, error) {
+	var chain auth.Chain
+
+	keys, err := auth.ParseAPIKeys(strings.NewReader(*authAPIKeys))
+	if err != nil {
+		return nil, err
+	}
+
+	if *authAPIKeysFile != "" {
+		fk, err := auth.LoadAPIKeys(*authAPIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, id := range fk {
+			keys[k] = id
+		}
+	}
+
+	if len(keys) > 0 {
+		chain = append(chain, auth.NewAPIKeys(keys))
+	}
+
+	jc := auth.JWTConfig{
+		Secret:   []byte(*authJWTSecret),
+		Issuer:   *authJWTIssuer,
+		Audience: *authJWTAudience,
+	}
+
+	if *authJWKSFile != "" {
+		jc.Keys, err = auth.LoadJWKS(*authJWKSFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(jc.Keys) == 0 {
+			return nil, fmt.Errorf("no signing keys in %s", *authJWKSFile)
+		}
+	}
+
+	if len(jc.Secret) > 0 || len(jc.Keys) > 0 {
+		j, err := auth.NewJWT(jc)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, j)
+	}
+
+	if len(chain) == 0 {
+		return nil, nil
+	}
+
+	return chain, nil
+}
+
+// parseNetworks parses a list of IP addresses and CIDR ranges, an address is
+// a network containing only that address
+func parseNetworks(l []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range l {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %s", s, err)
+		}
+
+		networks = append(networks, n)
+	}
+
+	return networks, nil
+}
+
+// splitList splits a comma separated list removing empty items
+func splitList(s string) []string {
+	var l []string
+	for _, i := range strings.Split(s, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			l = append(l, i)
+		}
+	}
 
-	logger.Log().Info("Starting server")
-	err = http.ListenAndServe(*bindAddress, handler)
-	logger.Log().Error("Unable to start server", "error", err)
+	return l
 }
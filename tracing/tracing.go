@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters which can be passed to New
+const (
+	ExporterNone   = "none"
+	ExporterZipkin = "zipkin"
+	ExporterFile   = "file"
+)
+
+const tracerName = "github.com/emojify-app/api/tracing"
+
+// Config configures the exporter used for spans
+type Config struct {
+	ServiceName string
+	Version     string
+	// Exporter is one of [none,zipkin,file], when none spans are not recorded
+	// but the trace context is still propagated to the upstream services
+	Exporter string
+	// Endpoint is the URL of the Zipkin collector e.g.
+	// http://localhost:9411/api/v2/spans
+	Endpoint string
+	// File is the path which spans are appended to as JSON by the file
+	// exporter
+	File string
+	// SampleRatio is the fraction of new traces which are sampled, requests
+	// with a sampled parent are always sampled
+	SampleRatio float64
+}
+
+// New configures the global tracer provider and propagator, the returned
+// function flushes any buffered spans and must be called before the service
+// exits
+func New(c Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(Propagator())
+
+	var exporter sdktrace.SpanExporter
+	closeFile := func() error { return nil }
+
+	switch c.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+
+	case ExporterZipkin:
+		e, err := zipkin.New(c.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter = e
+
+	case ExporterFile:
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		exporter = e
+		closeFile = f.Close
+
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %s, must be one of [%s,%s,%s]", c.Exporter, ExporterNone, ExporterZipkin, ExporterFile)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", c.ServiceName),
+			attribute.String("service.version", c.Version),
+		)),
+	)
+
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if cerr := closeFile(); err == nil {
+			err = cerr
+		}
+
+		return err
+	}, nil
+}
+
+// Propagator returns the propagator used for inbound and outbound requests,
+// the trace context is read from W3C traceparent or B3 headers and written
+// as both
+func Propagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+		b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)),
+	)
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
@@ -0,0 +1,164 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceParent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+func setupRecorder() *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(Propagator())
+
+	return sr
+}
+
+func setupRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/emojify/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	})
+
+	return r
+}
+
+func TestMiddlewareStartsServerSpanNamedAfterRoute(t *testing.T) {
+	sr := setupRecorder()
+	rw := httptest.NewRecorder()
+
+	setupRouter().ServeHTTP(rw, httptest.NewRequest("GET", "/emojify/abc", nil))
+
+	spans := sr.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "GET /emojify/{id}", spans[0].Name())
+		assert.Contains(t, spans[0].Attributes(), attribute.Int("http.response.status_code", http.StatusNotFound))
+	}
+}
+
+func TestMiddlewareContinuesW3CTrace(t *testing.T) {
+	sr := setupRecorder()
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/emojify/abc", nil)
+	r.Header.Set("traceparent", testTraceParent)
+
+	setupRouter().ServeHTTP(rw, r)
+
+	spans := sr.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, testTraceID, spans[0].SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+	}
+}
+
+func TestMiddlewareContinuesB3Trace(t *testing.T) {
+	sr := setupRecorder()
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/emojify/abc", nil)
+	r.Header.Set("x-b3-traceid", testTraceID)
+	r.Header.Set("x-b3-spanid", "00f067aa0ba902b7")
+	r.Header.Set("x-b3-sampled", "1")
+
+	setupRouter().ServeHTTP(rw, r)
+
+	spans := sr.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, testTraceID, spans[0].SpanContext().TraceID().String())
+	}
+}
+
+func TestMiddlewarePreservesFlusher(t *testing.T) {
+	setupRecorder()
+	var flusher bool
+
+	h := Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, flusher = rw.(http.Flusher)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.True(t, flusher)
+}
+
+func TestInterceptorInjectsTraceContextIntoMetadata(t *testing.T) {
+	sr := setupRecorder()
+	ctx, span := tracer().Start(context.Background(), "parent")
+
+	var md metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "emojify-option-x", "y")
+	err := UnaryClientInterceptor()(ctx, "/emojify.Emojify/Create", nil, nil, nil, invoker)
+	span.End()
+
+	assert.NoError(t, err)
+	assert.NotEmpty(t, md.Get("traceparent"))
+	assert.Equal(t, []string{span.SpanContext().TraceID().String()}, md.Get("x-b3-traceid"))
+	assert.Equal(t, []string{"y"}, md.Get("emojify-option-x"))
+
+	spans := sr.Ended()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "emojify.Emojify/Create", spans[0].Name())
+		assert.Contains(t, spans[0].Attributes(), attribute.String("rpc.method", "Create"))
+	}
+}
+
+func TestInterceptorRecordsErrorStatus(t *testing.T) {
+	sr := setupRecorder()
+
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return status.Error(codes.Unavailable, "boom")
+	}
+
+	err := UnaryClientInterceptor()(context.Background(), "/cache.Cache/Get", nil, nil, nil, invoker)
+
+	assert.Error(t, err)
+	spans := sr.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.Contains(t, spans[0].Attributes(), attribute.Int64("rpc.grpc.status_code", int64(codes.Unavailable)))
+		assert.Equal(t, "boom", spans[0].Status().Description)
+	}
+}
+
+func TestFileExporterWritesSpans(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "traces.json")
+
+	shutdown, err := New(Config{ServiceName: "api", Exporter: ExporterFile, File: f, SampleRatio: 1})
+	assert.NoError(t, err)
+
+	_, span := tracer().Start(context.Background(), "test-span")
+	span.End()
+
+	assert.NoError(t, shutdown(context.Background()))
+
+	d, _ := ioutil.ReadFile(f)
+	assert.Contains(t, string(d), "test-span")
+}
+
+func TestNewReturnsErrorForUnknownExporter(t *testing.T) {
+	_, err := New(Config{Exporter: "jaeger"})
+
+	assert.Error(t, err)
+}